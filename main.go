@@ -8,7 +8,7 @@
 //
 // ★本版の実行結果表示は phpunit 風に変更：
 //
-//	・成功: '.'、失敗(アサーション): 'F'、実行エラー: 'E' を進捗として出力
+//	・成功: '.'、失敗(アサーション): 'F'、実行エラー: 'E'、スキップ: 'S'、フックの失敗: 'H' を進捗として出力
 //	・詳細は E/F のみ最後にまとめて表示（成功ケースの詳細は表示しない）
 //
 // さらに **SQLジェネレータを同梱**：
@@ -16,7 +16,10 @@
 //
 //	gen-sql  … .sql を走査して *.test.jsonc と expected を生成（任意で -combine で test.json 作成）
 //	           IF/BEGIN/OPTIONAL ブロックから「パラメータ有/無」のバリアントも自動生成（キー名ベース）
+//	gen-api  … NyanQL の api.json からエンドポイントごとに *.test.jsonc を生成
 //	combine  … *.test.jsonc をまとめ直して test.json を生成
+//	lint     … テンプレートを DB なしで静的チェック（text / JSON / SARIF）
+//	fuzz     … テンプレートをランダムな params でレンダリング（と実行）し、構文エラーを報告
 //
 // ビルド:
 //
@@ -36,15 +39,22 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"math/rand/v2"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -68,15 +78,39 @@ NyanTEST - NyanQL-style SQL template tester (with SQL generator)
 
 SUBCOMMANDS
   gen-sql  Generate SQL test templates (1 sql => 1..N *.test.jsonc), optional -combine test.json
+  gen-api  Generate one test per endpoint from a NyanQL api.json, optional -combine test.json
   combine  Combine *.test.jsonc into a single test.json
+  lint     Statically check NyanQL templates (text / json / sarif output)
+  fuzz     Render templates with random params and report minimal param sets causing syntax errors
 
 RUNNER (default when no subcommand):
   - Render templated SQL with parameters (JSONC allowed) and compare to expected
   - Execute on DB in a single transaction (default: rollback)
   - Generate missing params/expected with -auto-params / -auto-expected
   - Update expected with -snapshot-update
+  - Dialect-specific expected: name.expected.<dialect>.sql is preferred over name.expected.sql
+  - EXPLAIN plan assertions per test ("plan": forbidFullScan / mustUseIndex / match / snapshot)
+  - Result snapshots of the final SELECT ("result": name.result.json)
+  - Column name/type assertions for the final SELECT ("expectColumns")
+  - NyanQL-style JSON response snapshots ("response": name.response.json)
+  - Multi-SQL tests: "steps" run several templates in order in one transaction
+    ("capture" passes values such as $.rows[0].id / $.lastInsertId to later steps)
+  - Syntax check without a DB server: prepare on in-memory sqlite / duckdb (-syntax-check)
   - Output JUnit XML with -junit-out
-  - phpunit-like progress: '.' (pass), 'F' (assertion failure), 'E' (error)
+  - Watch mode: poll the tests' input files and re-run only the changed tests (-watch)
+  - Per-test time budgets (maxDurationMs / -max-duration-ms) and slowest-N report
+  - Skip / todo markers per test ("skip": "reason", "todo": true)
+  - Driver-specific tests ("drivers": ["pgx","duckdb"] / "skipDrivers"), reported as skipped
+  - ${ENV} / ${ENV:-default} expansion in -nyanconf, test.json, -dsn and params JSONC
+  - Unused params keys / defaulted placeholders counted in the summary (-params-warnings to list, -strict-params to fail)
+  - Placeholders left unreplaced (unsupported default literal) are reported with their line
+  - Dialect-aware literal escaping from the resolved driver (mysql backslashes, postgres E'...')
+  - Typed params: {"$date"}, {"$timestamp"}, {"$decimal"}, {"$bytes"} (base64), {"$raw"}
+  - SQL injection probes for string params (-fuzz-injection)
+  - Template branch coverage of OPTIONAL / IF / BEGIN blocks (-coverage, JSON / lcov output)
+  - Suite hooks in test.json: beforeAll / afterAll / beforeEach / afterEach (SQL files, "inTx")
+  - phpunit-like progress: '.' (pass), 'F' (assertion failure), 'E' (error), 'S' (skipped),
+    'H' (hook failure)
 `
 
 /* ============== Types (Runner) ============== */
@@ -89,6 +123,19 @@ type TestCase struct {
 	ParamsPath   string         // JSONC path（test.json からの相対）
 	ParamsInline map[string]any // inline object
 	ActualOut    string         // rendered SQL の出力先（任意）
+	Plan         *PlanSpec      // EXPLAIN による実行計画アサーション（任意）
+	MaxDuration  int            // 実行時間の上限 ms（0 なら -max-duration-ms）
+	Timeout      int            // 文実行のタイムアウト秒（0 なら -timeout）
+	SeedTimeout  int            // seed 実行のタイムアウト秒（0 なら -seed-timeout）
+	Result       *ResultSpec    // 最後の SELECT の結果スナップショット（任意）
+	Columns      []ColumnSpec   // 最後の SELECT の列名（と型）のアサーション（任意）
+	Response     *ResponseSpec  // 最後の SELECT を NyanQL 形式 JSON にしたスナップショット（任意）
+	Steps        []TestStep     // 複数SQLを順に実行する場合（SQLPath/Expected の代わり）
+	Skip         bool           // 実行せずスキップ（"skip": true または理由の文字列）
+	SkipReason   string         // "skip" に書かれた理由（任意）
+	Todo         bool           // 未実装のテスト（スキップ扱い）
+	Drivers      []string       // 実行するドライバ（空なら全て）。例: "pgx", "duckdb"
+	SkipDrivers  []string       // スキップするドライバ
 }
 
 type LogConfig struct {
@@ -138,12 +185,18 @@ type junitSuite struct {
 	Skipped  int         `xml:"skipped,attr"`
 	Time     string      `xml:"time,attr"`
 	Cases    []junitCase `xml:"testcase"`
+	Out      string      `xml:"system-out,omitempty"`
+	Err      string      `xml:"system-err,omitempty"`
 }
 type junitCase struct {
 	Name    string     `xml:"name,attr"`
 	Time    string     `xml:"time,attr"`
 	Failure *junitFail `xml:"failure,omitempty"`
 	Error   *junitErr  `xml:"error,omitempty"`
+	Skipped *junitSkip `xml:"skipped,omitempty"`
+}
+type junitSkip struct {
+	Message string `xml:"message,attr,omitempty"`
 }
 type junitFail struct {
 	Message string `xml:"message,attr,omitempty"`
@@ -166,6 +219,7 @@ var (
 	globalSeed     string
 	noexec         bool
 	timeoutSec     int
+	seedTimeoutSec int
 	printSQL       bool
 	doCommit       bool
 	readOnly       bool
@@ -173,10 +227,28 @@ var (
 	autoParams     bool
 	autoExpected   bool
 	snapshotUpdate bool
+	dialectExp     bool
 	junitOut       string
 
 	onlyList string
 	runRegex string
+
+	maxDurationMs int
+	slowestN      int
+	strictParams  bool
+	paramsWarns   bool
+	fuzzInjection bool
+
+	coverageOn   bool
+	coverageOut  string
+	coverageLcov string
+
+	syntaxCheck  bool
+	syntaxDBOpt  string
+	syntaxSchema string
+
+	watch           bool
+	watchIntervalMs int
 )
 
 func init() {
@@ -187,7 +259,8 @@ func init() {
 	flag.StringVar(&globalSeed, "seed", "", "optional global seed.sql (executed inside test transaction)")
 
 	flag.BoolVar(&noexec, "noexec", false, "render+compare only; skip DB execution")
-	flag.IntVar(&timeoutSec, "timeout", 15, "DB execution timeout seconds")
+	flag.IntVar(&timeoutSec, "timeout", 15, "DB statement execution timeout seconds (test timeoutSec overrides)")
+	flag.IntVar(&seedTimeoutSec, "seed-timeout", 0, "seed execution timeout seconds (0: same as statement timeout; test seedTimeoutSec overrides)")
 	flag.BoolVar(&printSQL, "print-sql", false, "include rendered SQL in E/F details")
 	flag.BoolVar(&doCommit, "commit", false, "commit after execution (default: rollback)")
 	flag.BoolVar(&readOnly, "readonly", false, "enforce READ ONLY (where supported); writes will error")
@@ -196,11 +269,30 @@ func init() {
 	flag.BoolVar(&autoParams, "auto-params", false, "generate params JSONC if missing (SQL placeholders -> empty values)")
 	flag.BoolVar(&autoExpected, "auto-expected", false, "generate expected SQL if missing (rendered result)")
 	flag.BoolVar(&snapshotUpdate, "snapshot-update", false, "always overwrite expected with current rendered SQL")
+	flag.BoolVar(&dialectExp, "expected-dialect", false, "write -auto-expected / -snapshot-update output to name.expected.<dialect>.sql")
 	flag.StringVar(&junitOut, "junit-out", "", "write a JUnit XML report to this path")
 
 	flag.StringVar(&onlyList, "only", "", `comma-separated test names to run (e.g. "test1,test3")`)
 	flag.StringVar(&runRegex, "run", "", `regular expression to select tests by name (e.g. "^group:")`)
 
+	flag.IntVar(&maxDurationMs, "max-duration-ms", 0, "default per-test time budget in ms (0: no limit; test maxDurationMs overrides)")
+	flag.IntVar(&slowestN, "slowest", 5, "show the N slowest tests in the summary and JUnit report (0: off)")
+
+	flag.BoolVar(&fuzzInjection, "fuzz-injection", false, "probe every string param with hostile values (quotes, backslashes, comments, NUL...); fail if the statement structure changes or the DB reports a syntax error")
+	flag.BoolVar(&strictParams, "strict-params", false, "fail tests with unused params keys or placeholders left at their defaults")
+	flag.BoolVar(&paramsWarns, "params-warnings", false, "list the params warnings of each test (default: only the count in the summary)")
+
+	flag.BoolVar(&coverageOn, "coverage", false, "report template branch coverage (OPTIONAL / IF / BEGIN blocks) in the summary")
+	flag.StringVar(&coverageOut, "coverage-out", "", "write template coverage as JSON to this path (implies -coverage)")
+	flag.StringVar(&coverageLcov, "coverage-lcov", "", "write template coverage in lcov format to this path (implies -coverage)")
+
+	flag.BoolVar(&syntaxCheck, "syntax-check", false, "prepare the rendered SQL on an in-memory sqlite/duckdb and fail on syntax errors (works with -noexec)")
+	flag.StringVar(&syntaxDBOpt, "syntax-db", "", "engine for -syntax-check: sqlite|duckdb (default: duckdb for postgres/duckdb, sqlite for sqlite; required for mysql)")
+	flag.StringVar(&syntaxSchema, "syntax-schema", "", "schema / migrations for -syntax-check (a .sql file or a directory of *.sql, applied in name order)")
+
+	flag.BoolVar(&watch, "watch", false, "watch the files of the loaded tests (polling) and re-run only the tests whose inputs changed")
+	flag.IntVar(&watchIntervalMs, "watch-interval-ms", 500, "polling interval for -watch in ms")
+
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, usageText)
 		flag.PrintDefaults()
@@ -217,9 +309,18 @@ func main() {
 		case "gen-sql":
 			genSQLCmd(os.Args[2:])
 			return
+		case "gen-api":
+			genAPICmd(os.Args[2:])
+			return
 		case "combine":
 			combineCmd(os.Args[2:])
 			return
+		case "lint":
+			lintCmd(os.Args[2:])
+			return
+		case "fuzz":
+			fuzzCmd(os.Args[2:])
+			return
 		}
 	}
 
@@ -237,6 +338,11 @@ func main() {
 
 	tests, err := loadTests(configPath, cfgDir)
 	dieIf(err)
+	testHooks, err = loadHooks(configPath, cfgDir)
+	dieIf(err)
+	if coverageOn || coverageOut != "" || coverageLcov != "" {
+		coverage = newTemplateCoverage()
+	}
 
 	tests = filterTests(tests, onlyList, runRegex)
 	if len(tests) == 0 {
@@ -244,16 +350,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	var conf *NyanConfig
-	if nyanConf != "" {
-		b, err := os.ReadFile(nyanConf)
-		dieIf(err)
-		var c NyanConfig
-		s := stripTrailingCommas(stripJSONC(string(b)))
-		dieIf(json.Unmarshal([]byte(s), &c))
-		conf = &c
-	}
+	conf, err := loadNyanConf(nyanConf)
+	dieIf(err)
 
+	if dsn != "" {
+		dsn, err = expandEnv(dsn, false)
+		if err != nil {
+			dieIf(fmt.Errorf("-dsn: %w", err))
+		}
+	}
 	drv, effDSN, err := resolveDB(conf, driver, dsn)
 	dieIf(err)
 
@@ -268,26 +373,160 @@ func main() {
 	if readOnly {
 		fmt.Println("note: READ ONLY (best-effort)")
 	}
+	if syntaxCheck || syntaxDBOpt != "" || syntaxSchema != "" {
+		syntaxEng, err = syntaxEngine(dialectName(drv))
+		dieIf(err)
+		syntaxDB, err = openSyntaxDB(syntaxEng, dialectName(drv), syntaxSchema)
+		dieIf(err)
+		defer syntaxDB.Close()
+		fmt.Printf("note: syntax check on in-memory %s\n", syntaxEng)
+	}
 	fmt.Println()
 
+	if watch {
+		watchTests(tests, cfgDir, drv, effDSN, conf)
+		return
+	}
+	if !runSuite(tests, cfgDir, drv, effDSN, conf) {
+		os.Exit(1)
+	}
+}
+
+// テストを実行して進捗・失敗の詳細・サマリを出す（JUnit / カバレッジの書き出しも）。
+// 失敗・エラー・フックの失敗が無ければ true
+func runSuite(tests []TestCase, cfgDir, drv, effDSN string, conf *NyanConfig) bool {
 	fail := 0
 	errCount := 0
+	skipped := 0
+	paramWarns := 0
+	hookErrs := 0     // beforeAll/afterAll を含む
+	caseHookErrs := 0 // beforeEach/afterEach（JUnit では error 扱い）
 	var cases []junitCase
 	startSuite := time.Now()
 
 	// 失敗/エラーの詳細を最後に出すためバッファ
 	type detail struct {
 		name    string
-		kind    string // "F" or "E"
+		kind    string // "F" / "E" / "H" / "S" / "W"（params の警告）
 		timeSec float64
 		text    string // メッセージ＋差分等
 	}
 	var details []detail
 
+	// フックとテストで共有する接続（開けなければテストごとに開き、エラーはそれぞれで報告する）
+	if !noexec {
+		if sess, err := openSession(drv, effDSN, conf, time.Duration(seedTimeoutSec+timeoutSec)*time.Second); err == nil {
+			suiteSession = sess
+			defer func() {
+				suiteSession.Close()
+				suiteSession = nil
+			}()
+		}
+	}
+
+	// beforeAll / afterAll（-noexec では実行しない）。beforeAll が失敗したらテストは実行しない
+	var suiteErr strings.Builder
+	suiteHook := func(kind string, hs []hookSQL) bool {
+		if noexec {
+			return true
+		}
+		t0 := time.Now()
+		if err := runSuiteHooks(kind, hs, drv, effDSN, conf, time.Duration(seedTimeoutSec+timeoutSec)*time.Second); err != nil {
+			hookErrs++
+			msg := err.Error()
+			var se *stmtError
+			if printSQL && errors.As(err, &se) {
+				msg += "\n--- Hook SQL ---\n" + se.stmt + "\n--------------------"
+			}
+			details = append(details, detail{name: "(" + kind + ")", kind: "H", timeSec: time.Since(t0).Seconds(), text: msg})
+			fmt.Fprintf(&suiteErr, "%s\n", err)
+			return false
+		}
+		return true
+	}
+	runTests := tests
+	if !suiteHook("beforeAll", testHooks.BeforeAll) {
+		runTests = nil
+		// サマリや JUnit でもテストが消えないよう、実行しなかったテストはスキップとして残す
+		reason := "not run: beforeAll failed: " + abbrev(strings.TrimSpace(suiteErr.String()), 200)
+		for _, tc := range tests {
+			skipped++
+			fmt.Print("S")
+			details = append(details, detail{name: tc.Name, kind: "S", text: reason})
+			cases = append(cases, junitCase{
+				Name: tc.Name, Time: "0.000",
+				Skipped: &junitSkip{Message: reason},
+			})
+		}
+	}
+
+	// slowest N 表示用
+	type timing struct {
+		name    string
+		elapsed time.Duration
+		phases  phaseTimes
+	}
+	var timings []timing
+
 	// 進捗行（phpunit風）。※ここでは per-test の見出しや成功メッセージは一切出さない
-	for _, tc := range tests {
+	for _, tc := range runTests {
+		if reason := skipReason(tc, drv); reason != "" {
+			skipped++
+			fmt.Print("S")
+			details = append(details, detail{name: tc.Name, kind: "S", text: reason})
+			cases = append(cases, junitCase{
+				Name: tc.Name, Time: "0.000",
+				Skipped: &junitSkip{Message: reason},
+			})
+			continue
+		}
 		t0 := time.Now()
-		actual, e := runOne(tc, cfgDir, drv, effDSN, conf)
+		var pt phaseTimes
+		pu := newParamUsage()
+		actual, e := runOne(tc, cfgDir, drv, effDSN, conf, &pt, pu)
+		elapsed := time.Since(t0)
+		timings = append(timings, timing{name: tc.Name, elapsed: elapsed, phases: pt})
+
+		budget := tc.MaxDuration
+		if budget <= 0 {
+			budget = maxDurationMs
+		}
+		if e == nil && budget > 0 && elapsed > time.Duration(budget)*time.Millisecond {
+			e = &assertionError{
+				kind: "Time budget exceeded",
+				msg:  fmt.Sprintf("took %dms > maxDurationMs %d (%s)", elapsed.Milliseconds(), budget, pt),
+			}
+		}
+		// 注入プローブ（所要時間・時間予算には含めない）
+		if fuzzInjection && e == nil {
+			e = probeInjection(tc, drv, effDSN, conf)
+		}
+		if issues := pu.issues(); issues != "" {
+			if strictParams && e == nil {
+				e = &assertionError{kind: "Params mismatch", msg: issues}
+			} else {
+				// -strict-params でも、すでに失敗したテストの食い違いは警告として残す
+				details = append(details, detail{name: tc.Name, kind: "W", text: issues})
+				paramWarns++
+			}
+		}
+
+		// 失敗したテストのあと、共有の接続が切れていたら張り替えて、"reconnect": true の beforeAll を流し直す
+		// （以降のテストが全部 "bad connection" にならないように）
+		if e != nil && suiteSession != nil {
+			if ok, err := suiteSession.repin(time.Duration(seedTimeoutSec+timeoutSec) * time.Second); err != nil {
+				e = fmt.Errorf("%w\n(the shared connection was lost and could not be replaced: %v)", e, err)
+			} else if ok {
+				e = fmt.Errorf("%w\n(the shared connection was lost; later tests run on a new connection)", e)
+				var hs []hookSQL
+				for _, h := range testHooks.BeforeAll {
+					if h.reconnect {
+						hs = append(hs, h)
+					}
+				}
+				suiteHook("beforeAll", hs)
+			}
+		}
 
 		switch classifyErr(e) {
 		case "F":
@@ -300,12 +539,12 @@ func main() {
 			details = append(details, detail{
 				name:    tc.Name,
 				kind:    "F",
-				timeSec: time.Since(t0).Seconds(),
+				timeSec: elapsed.Seconds(),
 				text:    msg,
 			})
 			cases = append(cases, junitCase{
-				Name: tc.Name, Time: fmt.Sprintf("%.3f", time.Since(t0).Seconds()),
-				Failure: &junitFail{Message: "SQL mismatch", Type: "AssertionError", Text: msg},
+				Name: tc.Name, Time: fmt.Sprintf("%.3f", elapsed.Seconds()),
+				Failure: &junitFail{Message: failureMessage(e), Type: "AssertionError", Text: msg},
 			})
 		case "E":
 			errCount++
@@ -317,23 +556,47 @@ func main() {
 			details = append(details, detail{
 				name:    tc.Name,
 				kind:    "E",
-				timeSec: time.Since(t0).Seconds(),
+				timeSec: elapsed.Seconds(),
 				text:    msg,
 			})
 			cases = append(cases, junitCase{
-				Name: tc.Name, Time: fmt.Sprintf("%.3f", time.Since(t0).Seconds()),
+				Name: tc.Name, Time: fmt.Sprintf("%.3f", elapsed.Seconds()),
 				Error: &junitErr{Message: "Test execution error", Type: "Error", Text: msg},
 			})
+		case "H":
+			hookErrs++
+			caseHookErrs++
+			fmt.Print("H")
+			msg := e.Error()
+			var se *stmtError
+			if printSQL && errors.As(e, &se) {
+				msg += "\n--- Hook SQL ---\n" + se.stmt + "\n--------------------"
+			}
+			if printSQL && strings.TrimSpace(actual) != "" {
+				msg += "\n--- Rendered SQL ---\n" + actual + "\n--------------------"
+			}
+			details = append(details, detail{
+				name:    tc.Name,
+				kind:    "H",
+				timeSec: elapsed.Seconds(),
+				text:    msg,
+			})
+			cases = append(cases, junitCase{
+				Name: tc.Name, Time: fmt.Sprintf("%.3f", elapsed.Seconds()),
+				Error: &junitErr{Message: "Hook failed", Type: "HookError", Text: msg},
+			})
 		default:
 			fmt.Print(".")
 			cases = append(cases, junitCase{
-				Name: tc.Name, Time: fmt.Sprintf("%.3f", time.Since(t0).Seconds()),
+				Name: tc.Name, Time: fmt.Sprintf("%.3f", elapsed.Seconds()),
 			})
 		}
 	}
 
 	fmt.Println() // 進捗行の改行
 
+	suiteHook("afterAll", testHooks.AfterAll)
+
 	// 失敗/エラー詳細（成功ケースの詳細は出さない）
 	if fail > 0 {
 		fmt.Printf("\nFailures (%d):\n", fail)
@@ -357,10 +620,87 @@ func main() {
 			i++
 		}
 	}
+	if skipped > 0 {
+		fmt.Printf("\nSkipped (%d):\n", skipped)
+		i := 1
+		for _, d := range details {
+			if d.kind != "S" {
+				continue
+			}
+			fmt.Printf("%d) %s: %s\n", i, d.name, d.text)
+			i++
+		}
+		fmt.Println()
+	}
+	if paramWarns > 0 && !paramsWarns {
+		fmt.Printf("\nParams warnings: %d test(s) (use -params-warnings to list them)\n\n", paramWarns)
+	}
+	if paramWarns > 0 && paramsWarns {
+		fmt.Printf("\nParams warnings (%d):\n", paramWarns)
+		i := 1
+		for _, d := range details {
+			if d.kind != "W" {
+				continue
+			}
+			fmt.Printf("%d) %s: %s\n", i, d.name, strings.ReplaceAll(d.text, "\n", "; "))
+			i++
+		}
+		fmt.Println()
+	}
+	if hookErrs > 0 {
+		fmt.Printf("\nHook errors (%d):\n", hookErrs)
+		i := 1
+		for _, d := range details {
+			if d.kind != "H" {
+				continue
+			}
+			fmt.Printf("%d) %s (%.3fs)\n%s\n\n", i, d.name, d.timeSec, d.text)
+			i++
+		}
+	}
+
+	// 遅いテスト上位 N 件
+	var slowest string
+	if slowestN > 0 && len(timings) > 0 {
+		sort.SliceStable(timings, func(i, j int) bool { return timings[i].elapsed > timings[j].elapsed })
+		n := min(slowestN, len(timings))
+		var b strings.Builder
+		fmt.Fprintf(&b, "Slowest %d test(s):\n", n)
+		for _, t := range timings[:n] {
+			fmt.Fprintf(&b, "  %.3fs  %s  (%s)\n", t.elapsed.Seconds(), t.name, t.phases)
+		}
+		slowest = b.String()
+		fmt.Printf("\n%s\n", slowest)
+	}
+
+	// テンプレートカバレッジ
+	if coverage != nil {
+		r := coverage.report()
+		fmt.Printf("%s\n", r)
+		if err := writeCoverage(coverageOut, coverageLcov, r); err != nil {
+			fmt.Fprintf(os.Stderr, "WARN: failed to write coverage: %v\n", err)
+		} else {
+			for _, p := range []string{coverageOut, coverageLcov} {
+				if p != "" {
+					fmt.Printf("Coverage written: %s\n", p)
+				}
+			}
+		}
+	}
 
 	// サマリ
-	fmt.Printf("Time: %.3fs, Tests: %d, Failures: %d, Errors: %d\n",
+	fmt.Printf("Time: %.3fs, Tests: %d, Failures: %d, Errors: %d",
 		time.Since(startSuite).Seconds(), len(tests), fail, errCount)
+	if skipped > 0 {
+		fmt.Printf(", Skipped: %d", skipped)
+	}
+	if hookErrs > 0 {
+		fmt.Printf(", Hook errors: %d", hookErrs)
+	}
+	fmt.Println()
+	if runTests == nil {
+		fmt.Println("note: tests were not run because beforeAll failed")
+	}
 
 	// JUnit
 	if strings.TrimSpace(junitOut) != "" {
@@ -368,10 +708,12 @@ func main() {
 			Name:     "NyanTEST",
 			Tests:    len(cases),
 			Failures: fail,
-			Errors:   errCount,
-			Skipped:  0,
+			Errors:   errCount + caseHookErrs,
+			Skipped:  skipped,
 			Time:     fmt.Sprintf("%.3f", time.Since(startSuite).Seconds()),
 			Cases:    cases,
+			Out:      slowest,
+			Err:      suiteErr.String(),
 		}
 		if err := writeJUnit(junitOut, suite); err != nil {
 			fmt.Fprintf(os.Stderr, "WARN: failed to write JUnit report: %v\n", err)
@@ -380,22 +722,292 @@ func main() {
 		}
 	}
 
-	if fail+errCount > 0 {
-		os.Exit(1)
+	return fail+errCount+hookErrs == 0
+}
+
+// スキップする理由（空なら実行する）。todo は skip の理由があれば併記する。
+// drivers / skipDrivers は resolveDB で決まったドライバ名（pgx は postgres とも書ける）で判定する
+func skipReason(tc TestCase, drv string) string {
+	if tc.Todo {
+		if tc.SkipReason != "" {
+			return "todo: " + tc.SkipReason
+		}
+		return "todo"
+	}
+	if tc.Skip {
+		if tc.SkipReason != "" {
+			return tc.SkipReason
+		}
+		return "skipped"
+	}
+	if len(tc.Drivers) > 0 && !matchDriver(tc.Drivers, drv) {
+		return fmt.Sprintf("driver %s not in drivers [%s]", drv, strings.Join(tc.Drivers, ", "))
+	}
+	if matchDriver(tc.SkipDrivers, drv) {
+		return fmt.Sprintf("driver %s is in skipDrivers", drv)
+	}
+	return ""
+}
+
+func matchDriver(list []string, drv string) bool {
+	for _, d := range list {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == drv || d == dialectName(drv) {
+			return true
+		}
 	}
+	return false
 }
 
-// 'F'（期待と不一致）/ 'E'（その他エラー）/ ''（成功）
+// 'F'（期待と不一致）/ 'E'（その他エラー）/ 'H'（フックの失敗）/ ''（成功）
 func classifyErr(e error) string {
 	if e == nil {
 		return ""
 	}
+	var he *hookError
+	if errors.As(e, &he) {
+		return "H"
+	}
 	if strings.HasPrefix(e.Error(), "SQL mismatch:") {
 		return "F"
 	}
+	var ae *assertionError
+	if errors.As(e, &ae) {
+		return "F"
+	}
 	return "E"
 }
 
+// アサーション失敗（'F' 扱い）。kind は JUnit の failure message にも使う
+type assertionError struct {
+	kind string // e.g. "Plan mismatch"
+	msg  string
+}
+
+func (e *assertionError) Error() string {
+	return e.kind + ":\n" + e.msg
+}
+
+func failureMessage(e error) string {
+	var ae *assertionError
+	if errors.As(e, &ae) {
+		return ae.kind
+	}
+	return "SQL mismatch"
+}
+
+/* ============== Watch mode (Runner) ============== */
+
+// ファイルの変更検出用（存在しないファイルはゼロ値。作成・削除も変更として扱う）
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func statFiles(dst map[string]fileStamp, paths []string) {
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		var st fileStamp
+		if info, err := os.Stat(p); err == nil {
+			st = fileStamp{mod: info.ModTime(), size: info.Size()}
+		}
+		dst[p] = st
+	}
+}
+
+// 前回から変わった（作成・削除を含む）ファイル
+func changedFiles(old, cur map[string]fileStamp) map[string]bool {
+	changed := map[string]bool{}
+	for p, st := range cur {
+		if o, ok := old[p]; !ok || !o.mod.Equal(st.mod) || o.size != st.size {
+			changed[p] = true
+		}
+	}
+	return changed
+}
+
+// 実行中にツール自身が書き出した expected / スナップショット（絶対パス）。
+// -watch はこれらを入力の変更として扱わないよう、実行後に取り直す
+var writtenFiles = map[string]bool{}
+
+// expected / スナップショットの書き出し。内容が同じなら書かない（mtime を変えない）
+func writeSnapshotFile(path, content string) error {
+	data := []byte(addNewline(content))
+	if b, err := os.ReadFile(path); err == nil && bytes.Equal(b, data) {
+		return nil
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		writtenFiles[abs] = true
+	}
+	return nil
+}
+
+// stamps のうち、ツールが書き出したファイルだけを今の状態に取り直す
+func restampWritten(stamps map[string]fileStamp) {
+	for p := range stamps {
+		if abs, err := filepath.Abs(p); err == nil && writtenFiles[abs] {
+			statFiles(stamps, []string{p})
+		}
+	}
+	clear(writtenFiles)
+}
+
+// テストの入力ファイル（sql / params / expected（dialect 別も）/ seed / 各スナップショット、steps の各ファイル）
+func testInputs(tc TestCase, dialect string) []string {
+	withDialect := func(p string) []string {
+		if p == "" {
+			return nil
+		}
+		return []string{p, dialectExpectedPath(p, dialect)}
+	}
+	out := []string{tc.SQLPath, tc.ParamsPath, tc.Seed}
+	out = append(out, withDialect(tc.Expected)...)
+	if tc.Plan != nil {
+		out = append(out, withDialect(tc.Plan.Snapshot)...)
+	}
+	if tc.Result != nil {
+		out = append(out, withDialect(tc.Result.Snapshot)...)
+	}
+	if tc.Response != nil {
+		out = append(out, withDialect(tc.Response.Snapshot)...)
+	}
+	for _, st := range tc.Steps {
+		out = append(out, st.SQLPath, st.ParamsPath)
+		out = append(out, withDialect(st.Expected)...)
+	}
+	return out
+}
+
+// test.json 全体に効くファイル（test.json 自身、-seed、フックの SQL）
+func suiteInputs() []string {
+	out := []string{configPath}
+	if globalSeed != "" {
+		out = append(out, rel(filepath.Dir(configPath), globalSeed))
+	}
+	for _, hs := range slices.Concat(testHooks.BeforeAll, testHooks.AfterAll, testHooks.BeforeEach, testHooks.AfterEach) {
+		out = append(out, hs.path)
+	}
+	return out
+}
+
+// -watch: 入力ファイルをポーリングし、変わったテストだけを再実行する（Ctrl+C で終了）。
+// test.json・-seed・フックが変わったら test.json を読み直し、定義が変わったテスト
+// （-seed やフックが変わった場合は全テスト）を再実行する
+func watchTests(tests []TestCase, cfgDir, drv, effDSN string, conf *NyanConfig) {
+	dialect := dialectName(drv)
+	interval := time.Duration(max(watchIntervalMs, 50)) * time.Millisecond
+
+	// 実行のたびに書き出すレポート（-junit-out / -coverage-out / -coverage-lcov）は入力として扱わない
+	outputs := map[string]bool{}
+	for _, p := range []string{junitOut, coverageOut, coverageLcov} {
+		if p = strings.TrimSpace(p); p != "" {
+			if abs, err := filepath.Abs(p); err == nil {
+				outputs[abs] = true
+			}
+		}
+	}
+	snapshot := func() map[string]fileStamp {
+		m := map[string]fileStamp{}
+		statFiles(m, suiteInputs())
+		for _, tc := range tests {
+			statFiles(m, testInputs(tc, dialect))
+		}
+		for p := range m {
+			if abs, err := filepath.Abs(p); err == nil && outputs[abs] {
+				delete(m, p)
+			}
+		}
+		return m
+	}
+	// 端末でないとき（ログへのリダイレクトなど）はエスケープシーケンスを出さない
+	clearScreen := false
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		clearScreen = true
+	}
+	// 実行中に編集されたファイルを取りこぼさないよう実行前に取り、ツールが書き出したものだけ実行後に取り直す
+	stamps := snapshot()
+	run := func(ts []TestCase, why string) {
+		if clearScreen {
+			fmt.Print("\033[H\033[2J") // 画面をクリア
+		}
+		fmt.Printf("NyanTEST watch: %s (%s)\n\n", why, time.Now().Format("15:04:05"))
+		if coverage != nil {
+			coverage = newTemplateCoverage()
+		}
+		clear(writtenFiles)
+		runSuite(ts, cfgDir, drv, effDSN, conf)
+		restampWritten(stamps)
+		fmt.Printf("\nwatching %d test(s) every %s (Ctrl+C to stop)\n", len(tests), interval)
+	}
+
+	run(tests, fmt.Sprintf("%d test(s)", len(tests)))
+	for {
+		time.Sleep(interval)
+		cur := snapshot()
+		changed := changedFiles(stamps, cur)
+		if len(changed) == 0 {
+			continue
+		}
+
+		var rerun []TestCase
+		all := false
+		if slices.ContainsFunc(suiteInputs(), func(p string) bool { return changed[p] }) {
+			loaded, err := loadTests(configPath, cfgDir)
+			if err == nil {
+				loaded = filterTests(loaded, onlyList, runRegex)
+			}
+			hooks, herr := loadHooks(configPath, cfgDir)
+			if err == nil {
+				err = herr
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nwatch: reload %s: %v\n", configPath, err)
+				stamps = cur
+				continue
+			}
+			seedPath := rel(filepath.Dir(configPath), globalSeed)
+			all = !reflect.DeepEqual(hooks, testHooks) || globalSeed != "" && changed[seedPath]
+			prev := map[string]TestCase{}
+			for _, tc := range tests {
+				prev[tc.Name] = tc
+			}
+			for _, tc := range loaded {
+				if old, ok := prev[tc.Name]; !ok || !reflect.DeepEqual(old, tc) {
+					rerun = append(rerun, tc)
+				}
+			}
+			tests, testHooks = loaded, hooks
+		}
+		// 読み直しで増えたファイルだけ今の状態を足す（既存のファイルは cur のまま比べる）
+		next := snapshot()
+		maps.Copy(next, cur)
+		stamps = next
+		if all {
+			rerun = tests
+		} else {
+			for _, tc := range tests {
+				if slices.ContainsFunc(testInputs(tc, dialect), func(p string) bool { return changed[p] }) &&
+					!slices.ContainsFunc(rerun, func(r TestCase) bool { return r.Name == tc.Name }) {
+					rerun = append(rerun, tc)
+				}
+			}
+		}
+
+		if len(rerun) > 0 {
+			names := make([]string, 0, len(rerun))
+			for _, tc := range rerun {
+				names = append(names, tc.Name)
+			}
+			run(filterTests(rerun, "", ""), fmt.Sprintf("re-running %d of %d test(s): %s", len(rerun), len(tests), abbrev(strings.Join(names, ", "), 200)))
+		}
+	}
+}
+
 /* ============== Test filtering (Runner) ============== */
 
 func filterTests(all []TestCase, onlyCSV, regex string) []TestCase {
@@ -442,47 +1054,72 @@ func filterTests(all []TestCase, onlyCSV, regex string) []TestCase {
 
 /* ============== Runner core ============== */
 
-func runOne(tc TestCase, cfgDir, drvName, effDSN string, conf *NyanConfig) (string, error) {
-	// 1) SQLテンプレ読み込み
-	tplBytes, err := os.ReadFile(tc.SQLPath)
-	if err != nil {
-		return "", fmt.Errorf("read sql: %w", err)
-	}
+// フェーズ別の所要時間（render / connect / seed / exec）
+type phaseTimes struct {
+	Render  time.Duration
+	Connect time.Duration
+	Seed    time.Duration
+	Exec    time.Duration
+}
 
-	// 2) params 読み込み（JSONC or inline）。-auto-params サポート
-	var paramsBytes []byte
-	if tc.ParamsInline != nil {
-		b, err := json.Marshal(tc.ParamsInline)
+func (p phaseTimes) String() string {
+	return fmt.Sprintf("render %.3fs, connect %.3fs, seed %.3fs, exec %.3fs",
+		p.Render.Seconds(), p.Connect.Seconds(), p.Seed.Seconds(), p.Exec.Seconds())
+}
+
+// pt にはフェーズ別の所要時間を記録する
+func runOne(tc TestCase, cfgDir, drvName, effDSN string, conf *NyanConfig, pt *phaseTimes, pu *paramUsage) (string, error) {
+	dialect := dialectName(drvName)
+
+	// 1)〜4) テンプレ読み込み → params → レンダリング（steps があれば各 step を順に）
+	tRender := time.Now()
+	var steps []execStep
+	var actualSQL string
+	if len(tc.Steps) == 0 {
+		sqlText, err := renderTemplate(tc.SQLPath, tc.ParamsPath, tc.ParamsInline, nil, dialect, pu)
+		pt.Render = time.Since(tRender)
 		if err != nil {
-			return "", fmt.Errorf("marshal inline params: %w", err)
+			return "", err
 		}
-		paramsBytes = b
+		actualSQL = sqlText
+		steps = []execStep{{sql: sqlText}}
 	} else {
-		b, err := os.ReadFile(tc.ParamsPath)
-		if err != nil {
-			if os.IsNotExist(err) && autoParams && strings.TrimSpace(tc.ParamsPath) != "" {
-				if e := autoGenParamsJSONC(tc.ParamsPath, string(tplBytes)); e != nil {
-					return "", fmt.Errorf("auto-gen params: %w", e)
+		// capture した値を使う step は、DB 実行時に前の step の結果を反映して再レンダリングする
+		captured := false
+		for i, st := range tc.Steps {
+			label := stepLabel(i, st)
+			sqlText, err := renderTemplate(st.SQLPath, st.ParamsPath, st.ParamsInline, nil, dialect, pu)
+			if err != nil {
+				pt.Render = time.Since(tRender)
+				return joinSteps(steps), fmt.Errorf("%s: %w", label, err)
+			}
+			es := execStep{label: label, sql: sqlText, capture: st.Capture}
+			if captured {
+				st := st
+				es.render = func(vars map[string]any) (string, error) {
+					q, err := renderTemplate(st.SQLPath, st.ParamsPath, st.ParamsInline, vars, dialect, pu)
+					if err != nil {
+						return "", err
+					}
+					if st.Expected != "" {
+						return q, compareExpected(st.Expected, dialect, q)
+					}
+					return q, nil
 				}
-				b, err = os.ReadFile(tc.ParamsPath)
 			}
+			steps = append(steps, es)
+			captured = captured || len(st.Capture) > 0
 		}
-		if err != nil {
-			return "", fmt.Errorf("read params: %w", err)
+		pt.Render = time.Since(tRender)
+		actualSQL = joinSteps(steps)
+		// capture で渡す値は最初のレンダリングでは未設定なので、デフォルト値扱いにしない
+		if pu != nil {
+			for _, st := range tc.Steps {
+				for k := range st.Capture {
+					delete(pu.defaulted, k)
+				}
+			}
 		}
-		paramsBytes = b
-	}
-
-	// 3) params デコード（JSONC対応）
-	params, err := decodeParams(paramsBytes)
-	if err != nil {
-		return "", fmt.Errorf("decode params: %w", err)
-	}
-
-	// 4) レンダリング
-	actualSQL, err := renderNyanSQL(string(tplBytes), params)
-	if err != nil {
-		return "", fmt.Errorf("render: %w", err)
 	}
 	// （成功ケースでは何も出力しない。詳細は最終まとめで E/F のみ）
 
@@ -492,25 +1129,26 @@ func runOne(tc TestCase, cfgDir, drvName, effDSN string, conf *NyanConfig) (stri
 	}
 
 	// 5) expected 読み込み/生成/更新/比較
-	expBytes, err := os.ReadFile(tc.Expected)
-	if err != nil && !os.IsNotExist(err) {
-		return actualSQL, fmt.Errorf("read expected: %w", err)
-	}
-	if os.IsNotExist(err) && autoExpected {
-		if err := os.MkdirAll(filepath.Dir(tc.Expected), 0o755); err != nil {
-			return actualSQL, fmt.Errorf("make expected dir: %w", err)
+	if len(tc.Steps) == 0 {
+		if err := compareExpected(tc.Expected, dialect, actualSQL); err != nil {
+			return actualSQL, err
 		}
-		if err := os.WriteFile(tc.Expected, []byte(addNewline(actualSQL)), 0o644); err != nil {
-			return actualSQL, fmt.Errorf("write expected: %w", err)
-		}
-	} else if snapshotUpdate && err == nil {
-		if err := os.WriteFile(tc.Expected, []byte(addNewline(actualSQL)), 0o644); err != nil {
-			return actualSQL, fmt.Errorf("snapshot update failed: %w", err)
+	} else {
+		for i, st := range tc.Steps {
+			// capture 値で再レンダリングする step は DB 実行時に比較する（-noexec では比較しない）
+			if st.Expected == "" || steps[i].render != nil {
+				continue
+			}
+			if err := compareExpected(st.Expected, dialect, steps[i].sql); err != nil {
+				return actualSQL, fmt.Errorf("%s: %w", steps[i].label, err)
+			}
 		}
-	} else if err == nil {
-		expectedSQL := string(expBytes)
-		if !equalSQL(expectedSQL, actualSQL) {
-			return actualSQL, fmt.Errorf("SQL mismatch:\n%s", diff(expectedSQL, actualSQL))
+	}
+
+	// 構文チェック（-syntax-check。DB なしでも壊れたテンプレートを検出する）
+	if syntaxDB != nil {
+		if err := checkSyntax(syntaxDB, syntaxEng, dialect, steps); err != nil {
+			return actualSQL, err
 		}
 	}
 
@@ -519,29 +1157,369 @@ func runOne(tc TestCase, cfgDir, drvName, effDSN string, conf *NyanConfig) (stri
 		return actualSQL, nil
 	}
 
-	// seeds: global -> per-test（テスト用トランザクション内で実行）
-	var seeds []string
-	if globalSeed != "" {
-		if b, err := os.ReadFile(rel(filepath.Dir(configPath), globalSeed)); err == nil {
-			seeds = append(seeds, string(b))
-		} else {
-			return actualSQL, fmt.Errorf("read global seed: %w", err)
-		}
+	seeds, err := loadSeeds(tc)
+	if err != nil {
+		return actualSQL, err
 	}
-	if tc.Seed != "" {
-		if b, err := os.ReadFile(tc.Seed); err == nil {
-			seeds = append(seeds, string(b))
-		} else {
-			return actualSQL, fmt.Errorf("read per-test seed: %w", err)
+
+	// SQL 実行後の検査（同じトランザクション内）。対象は最後の step の SQL
+	// （capture で再レンダリングされるため、実行後に参照する）
+	last := &steps[len(steps)-1]
+	var checks []func(ctx context.Context, tx *sql.Tx) error
+	if tc.Plan != nil {
+		checks = append(checks, func(ctx context.Context, tx *sql.Tx) error {
+			return checkPlan(ctx, tx, drvName, last.sql, tc.Plan)
+		})
+	}
+	if len(tc.Columns) > 0 {
+		checks = append(checks, func(ctx context.Context, tx *sql.Tx) error {
+			return checkColumns(ctx, tx, dialect, last.sql, tc.Columns)
+		})
+	}
+	if tc.Result != nil {
+		checks = append(checks, func(ctx context.Context, tx *sql.Tx) error {
+			return checkResult(ctx, tx, dialect, last.sql, snapshotTarget(tc.Result.Snapshot, dialect), tc.Result)
+		})
+	}
+	if tc.Response != nil {
+		checks = append(checks, func(ctx context.Context, tx *sql.Tx) error {
+			return checkResponse(ctx, tx, dialect, last.sql, snapshotTarget(tc.Response.Snapshot, dialect))
+		})
+	}
+	var post func(ctx context.Context, tx *sql.Tx) error
+	if len(checks) > 0 {
+		post = func(ctx context.Context, tx *sql.Tx) error {
+			for _, c := range checks {
+				if err := c(ctx, tx); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
 	}
 
-	if err := execOnDBTx(actualSQL, drvName, effDSN, seeds, conf, time.Duration(timeoutSec)*time.Second, doCommit, readOnly); err != nil {
+	stmtTO := firstPositive(tc.Timeout, timeoutSec)
+	seedTO := firstPositive(tc.SeedTimeout, seedTimeoutSec, stmtTO)
+
+	err = execOnDBTx(steps, drvName, effDSN, seeds, testHooks, conf, time.Duration(seedTO)*time.Second, time.Duration(stmtTO)*time.Second, doCommit, readOnly, post, pt)
+	if len(tc.Steps) > 0 {
+		actualSQL = joinSteps(steps)
+	}
+	if err != nil {
+		var ae *assertionError
+		var he *hookError
+		if errors.As(err, &ae) || errors.As(err, &he) {
+			return actualSQL, err
+		}
 		return actualSQL, fmt.Errorf("execute DB: %w", err)
 	}
 	return actualSQL, nil
 }
 
+// seeds: global -> per-test（テスト用トランザクション内で実行）
+func loadSeeds(tc TestCase) ([]string, error) {
+	var seeds []string
+	if globalSeed != "" {
+		if b, err := os.ReadFile(rel(filepath.Dir(configPath), globalSeed)); err == nil {
+			seeds = append(seeds, string(b))
+		} else {
+			return nil, fmt.Errorf("read global seed: %w", err)
+		}
+	}
+	if tc.Seed != "" {
+		if b, err := os.ReadFile(tc.Seed); err == nil {
+			seeds = append(seeds, string(b))
+		} else {
+			return nil, fmt.Errorf("read per-test seed: %w", err)
+		}
+	}
+	return seeds, nil
+}
+
+// テンプレ読み込み → params（JSONC or inline、-auto-params 対応）→ レンダリング。
+// vars（前の step で capture した値）は params に上書きでマージする
+// dialect は文字列リテラルのエスケープに使う。pu が nil でなければ params の使われ方を記録する
+func renderTemplate(sqlPath, paramsPath string, paramsInline map[string]any, vars map[string]any, dialect string, pu *paramUsage) (string, error) {
+	tplBytes, err := os.ReadFile(sqlPath)
+	if err != nil {
+		return "", fmt.Errorf("read sql: %w", err)
+	}
+
+	params, err := loadParams(paramsPath, paramsInline, string(tplBytes))
+	if err != nil {
+		return "", err
+	}
+	if pu != nil {
+		for k := range params {
+			if _, ok := vars[k]; !ok {
+				pu.provided[k] = true
+			}
+		}
+		for k := range templateKeys(string(tplBytes)) {
+			pu.used[k] = true
+		}
+	}
+	for k, v := range vars {
+		params[k] = v
+	}
+
+	tr := &renderTrace{}
+	if coverage != nil {
+		tr.blocks = coverage.recorder(sqlPath, string(tplBytes))
+	}
+	if pu != nil {
+		tr.defaulted = pu.defaulted
+		tr.leftover = pu.leftover
+	}
+	actualSQL, err := renderNyanSQLWith(string(tplBytes), params, dialect, tr)
+	if err != nil {
+		return "", fmt.Errorf("render: %w", err)
+	}
+	return actualSQL, nil
+}
+
+// params（インライン or JSONC ファイル。-auto-params なら tpl から生成、${ENV} を展開）を読み込む
+func loadParams(paramsPath string, paramsInline map[string]any, tpl string) (map[string]any, error) {
+	var paramsBytes []byte
+	if paramsInline != nil {
+		b, err := json.Marshal(paramsInline)
+		if err != nil {
+			return nil, fmt.Errorf("marshal inline params: %w", err)
+		}
+		paramsBytes = b
+	} else {
+		b, err := os.ReadFile(paramsPath)
+		if err != nil {
+			if os.IsNotExist(err) && autoParams && strings.TrimSpace(paramsPath) != "" {
+				if e := autoGenParamsJSONC(paramsPath, tpl); e != nil {
+					return nil, fmt.Errorf("auto-gen params: %w", e)
+				}
+				b, err = os.ReadFile(paramsPath)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read params: %w", err)
+		}
+		// コメント内の ${...} は展開しない
+		ps, err := expandEnv(stripJSONC(string(b)), true)
+		if err != nil {
+			return nil, fmt.Errorf("params %s: %w", paramsPath, err)
+		}
+		paramsBytes = []byte(ps)
+	}
+
+	params, err := decodeParams(paramsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decode params: %w", err)
+	}
+	return params, nil
+}
+
+// テストごとの params の使われ方（steps があれば全 step の合計）
+type paramUsage struct {
+	provided  map[string]bool // params（ファイル/インライン）にあるキー
+	used      map[string]bool // テンプレートが参照するキー
+	defaulted map[string]bool // キーが無くデフォルト値になったプレースホルダ
+	leftover  map[string]bool // 置換されずにコメントのまま残ったプレースホルダ
+}
+
+func newParamUsage() *paramUsage {
+	return &paramUsage{provided: map[string]bool{}, used: map[string]bool{}, defaulted: map[string]bool{}, leftover: map[string]bool{}}
+}
+
+// 未使用のキー／デフォルト値になったプレースホルダ（無ければ空）
+func (u *paramUsage) issues() string {
+	var unused, defaulted, leftover []string
+	for k := range u.provided {
+		if !u.used[k] {
+			unused = append(unused, k)
+		}
+	}
+	for k := range u.defaulted {
+		defaulted = append(defaulted, k)
+	}
+	for k := range u.leftover {
+		leftover = append(leftover, k)
+	}
+	sort.Strings(unused)
+	sort.Strings(defaulted)
+	sort.Strings(leftover)
+	var lines []string
+	if len(unused) > 0 {
+		lines = append(lines, "unused params: "+strings.Join(unused, ", "))
+	}
+	if len(defaulted) > 0 {
+		lines = append(lines, "defaulted placeholders: "+strings.Join(defaulted, ", "))
+	}
+	if len(leftover) > 0 {
+		lines = append(lines, "placeholders left in rendered SQL: "+strings.Join(leftover, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var reIfCond = regexp.MustCompile(`(?i)/\*IF\s+([^*]+?)\*/`)
+
+var reCondKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// テンプレートが参照するキー（プレースホルダ、/*? key ?*/、IF 条件の両辺のキー）
+func templateKeys(tpl string) map[string]bool {
+	keys := map[string]bool{}
+	for _, m := range rePlaceholder.FindAllStringSubmatch(tpl, -1) {
+		if !reBlockWord.MatchString(m[1]) {
+			keys[m[1]] = true
+		}
+	}
+	for _, m := range reBlockKeys.FindAllStringSubmatch(tpl, -1) {
+		keys[m[1]] = true
+	}
+	for _, m := range reIfCond.FindAllStringSubmatch(tpl, -1) {
+		for _, side := range strings.FieldsFunc(m[1], func(r rune) bool { return strings.ContainsRune("=!<>", r) }) {
+			side = strings.TrimSpace(side)
+			switch strings.ToLower(side) {
+			case "null", "true", "false":
+				continue
+			}
+			if reCondKey.MatchString(side) {
+				keys[side] = true
+			}
+		}
+	}
+	return keys
+}
+
+// expected の読み込み/生成/更新/比較。
+// name.expected.<dialect>.sql があれば name.expected.sql より優先。
+// -expected-dialect 指定時は生成/更新先を dialect 別ファイルにする
+func compareExpected(expected, dialect, actualSQL string) error {
+	expPath := snapshotTarget(expected, dialect)
+	expBytes, err := os.ReadFile(expPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read expected: %w", err)
+	}
+	if os.IsNotExist(err) && expPath != expected {
+		// dialect 別に書き出す場合でも、共通の expected と一致するなら作らない
+		if b, err := os.ReadFile(expected); err == nil && equalSQL(string(b), actualSQL) {
+			return nil
+		}
+	}
+	if os.IsNotExist(err) && (autoExpected || (snapshotUpdate && dialectExp)) {
+		if err := os.MkdirAll(filepath.Dir(expPath), 0o755); err != nil {
+			return fmt.Errorf("make expected dir: %w", err)
+		}
+		if err := writeSnapshotFile(expPath, actualSQL); err != nil {
+			return fmt.Errorf("write expected: %w", err)
+		}
+	} else if snapshotUpdate && err == nil {
+		if err := writeSnapshotFile(expPath, actualSQL); err != nil {
+			return fmt.Errorf("snapshot update failed: %w", err)
+		}
+	} else if err == nil {
+		expectedSQL := string(expBytes)
+		if !equalSQL(expectedSQL, actualSQL) {
+			return &assertionError{kind: "SQL mismatch", msg: diff(expectedSQL, actualSQL)}
+		}
+	}
+	return nil
+}
+
+/* ============== Multi-SQL steps (Runner) ============== */
+
+// test.json の "steps" の1要素（同じトランザクション内で順に実行）
+type TestStep struct {
+	Name         string
+	SQLPath      string
+	ParamsPath   string
+	ParamsInline map[string]any
+	Expected     string            // 任意
+	Capture      map[string]string // 次の step 以降の params に渡す値（キー → "$.rows[0].id" など）
+}
+
+func joinSteps(steps []execStep) string {
+	parts := make([]string, 0, len(steps))
+	for _, st := range steps {
+		parts = append(parts, "-- "+st.label+"\n"+st.sql)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// capture のパス:
+//
+//	$.rows[0].id    … 最後の文の結果（SELECT / RETURNING）の行・列
+//	$.lastInsertId  … 最後の文の LastInsertId
+//	$.rowsAffected  … 最後の文の RowsAffected
+var reCapturePath = regexp.MustCompile(`^\$\.(?:rows\[(\d+)\]\.(.+)|(lastInsertId|rowsAffected))$`)
+
+// capture に $.rows を含むか（最後の文を Query で実行する必要があるか）
+func captureNeedsRows(capture map[string]string) bool {
+	for _, p := range capture {
+		// $.rowsAffected も "$.rows" で始まるので、パスとして解釈して判定する
+		if m := reCapturePath.FindStringSubmatch(strings.TrimSpace(p)); m != nil && m[1] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// step の実行結果から capture の値を取り出して vars に入れる
+func applyCapture(capture map[string]string, res sql.Result, rs resultSet, vars map[string]any) error {
+	keys := make([]string, 0, len(capture))
+	for k := range capture {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := strings.TrimSpace(capture[key])
+		m := reCapturePath.FindStringSubmatch(path)
+		if m == nil {
+			return fmt.Errorf("capture %q: unsupported path %q (use $.rows[N].col, $.lastInsertId or $.rowsAffected)", key, path)
+		}
+		var v any
+		switch {
+		case m[3] == "lastInsertId" || m[3] == "rowsAffected":
+			if res == nil {
+				return fmt.Errorf("capture %q: no result for %s", key, path)
+			}
+			var n int64
+			var err error
+			if m[3] == "lastInsertId" {
+				n, err = res.LastInsertId()
+			} else {
+				n, err = res.RowsAffected()
+			}
+			if err != nil {
+				return fmt.Errorf("capture %q: %s: %w", key, m[3], err)
+			}
+			v = n
+		default:
+			idx, _ := strconv.Atoi(m[1])
+			if idx >= len(rs.Rows) {
+				return fmt.Errorf("capture %q: %s: only %d row(s) returned", key, path, len(rs.Rows))
+			}
+			val, ok := rs.Rows[idx][m[2]]
+			if !ok {
+				return fmt.Errorf("capture %q: %s: no column %q (columns: %s)", key, path, m[2], strings.Join(rs.Columns, ", "))
+			}
+			v = val
+		}
+		// params と同じ型（json.Number 等）にそろえる
+		pv, err := decodeParams([]byte(toJSONString(map[string]any{key: v})))
+		if err != nil {
+			return err
+		}
+		vars[key] = pv[key]
+	}
+	return nil
+}
+
+// エラー表示用の step 名: "step 2 (insert_user)"
+func stepLabel(i int, st TestStep) string {
+	name := st.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(st.SQLPath), filepath.Ext(st.SQLPath))
+	}
+	return fmt.Sprintf("step %d (%s)", i+1, name)
+}
+
 /* ============== DB config / DSN resolve (Runner) ============== */
 
 func resolveDB(conf *NyanConfig, flagDriver, flagDSN string) (driverName, DSN string, err error) {
@@ -599,6 +1577,26 @@ func resolveDB(conf *NyanConfig, flagDriver, flagDSN string) (driverName, DSN st
 	}
 }
 
+// NyanQL の config.json（JSONC 可、${ENV} を展開）を読む。path が空なら nil
+func loadNyanConf(path string) (*NyanConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := expandEnv(stripTrailingCommas(stripJSONC(string(b))), true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var c NyanConfig
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func mapDriver(d string) string {
 	if d == "postgres" {
 		return "pgx"
@@ -606,6 +1604,14 @@ func mapDriver(d string) string {
 	return d
 }
 
+// driver 名 → dialect 名（expected ファイル名などに使う。pgx は postgres）
+func dialectName(driverName string) string {
+	if driverName == "pgx" {
+		return "postgres"
+	}
+	return driverName
+}
+
 func defaultIfEmpty(v, def string) string {
 	if strings.TrimSpace(v) == "" {
 		return def
@@ -634,17 +1640,116 @@ type execer interface {
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 }
 
-func execOnDBTx(sqlText, driverName, dsn string, seeds []string, conf *NyanConfig, timeout time.Duration, doCommit, readOnly bool) error {
+// トランザクションを開始できる execer（*sql.DB / *sql.Conn）
+type txStarter interface {
+	execer
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// スイートで共有する DB と、そこから固定した1本の接続。
+// sqlite の :memory: や ATTACH / SET など接続ごとの状態を、フックとテストが同じ接続で共有する
+type dbSession struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+// runSuite の間だけ設定される（nil ならテストごとに接続を開く）
+var suiteSession *dbSession
+
+func openSession(driverName, dsn string, conf *NyanConfig, timeout time.Duration) (*dbSession, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	applyPool(db, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &dbSession{db: db, conn: conn}, nil
+}
+
+func (s *dbSession) Close() {
+	_ = s.conn.Close()
+	_ = s.db.Close()
+}
+
+// 固定した接続が使えなくなっていれば、プールから新しい接続を取り直す（取り直したら true）。
+// pgx / mysql はタイムアウトのキャンセルでドライバの接続を閉じ、sql.Conn は繋ぎ直さないため
+func (s *dbSession) repin(timeout time.Duration) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	if err := s.conn.PingContext(ctx); err == nil {
+		return false, nil
+	}
+	_ = s.conn.Close()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, err // s.conn は閉じたままなので、次のテストのあとでもう一度取り直す
+	}
+	s.conn = conn
+	return true, nil
+}
 
+// 共有の接続があればそれを、無ければ新しく開いた DB を返す（close は後始末）
+func sessionFor(driverName, dsn string, conf *NyanConfig) (txStarter, func(), error) {
+	if suiteSession != nil {
+		return suiteSession.conn, func() {}, nil
+	}
 	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	applyPool(db, conf)
+	return db, func() { _ = db.Close() }, nil
+}
+
+// execOnDBTx で順に実行する SQL（label はエラー表示用。単一SQLのテストでは空）
+type execStep struct {
+	label   string
+	sql     string
+	render  func(vars map[string]any) (string, error) // capture 値で再レンダリング（任意）
+	capture map[string]string
+}
+
+// post は SQL 実行後・commit/rollback 前に同じトランザクション内で呼ばれる（plan 検査など）
+// pt には connect / seed / exec の所要時間を記録する（nil 可）
+// seedTimeout は seed、timeout は本体SQL（＋post）に個別に適用する
+func execOnDBTx(steps []execStep, driverName, dsn string, seeds []string, hooks suiteHooks, conf *NyanConfig, seedTimeout, timeout time.Duration, doCommit, readOnly bool, post func(ctx context.Context, tx *sql.Tx) error, pt *phaseTimes) (err error) {
+	// トランザクションは BeginTx の ctx に縛られるため、全体は両フェーズの合計で区切る
+	ctx, cancel := context.WithTimeout(context.Background(), seedTimeout+timeout)
+	defer cancel()
+
+	if pt == nil {
+		pt = &phaseTimes{}
+	}
+	t0 := time.Now()
+
+	db, closeDB, err := sessionFor(driverName, dsn, conf)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer closeDB()
 
-	applyPool(db, conf)
+	// トランザクション外のフック（beforeEach は BEGIN 前、afterEach はテストの成否に関わらず最後）
+	dialect := dialectName(driverName)
+	if err := runHooks(ctx, db, dialect, "beforeEach", hooks.BeforeEach, false); err != nil {
+		return err
+	}
+	defer func() {
+		actx, acancel := context.WithTimeout(context.Background(), timeout)
+		defer acancel()
+		if herr := runHooks(actx, db, dialect, "afterEach", hooks.AfterEach, false); herr != nil {
+			if err == nil {
+				err = herr
+			} else {
+				err = fmt.Errorf("%w\n(also failed: %v)", err, herr)
+			}
+		}
+	}()
 
 	txOpts := &sql.TxOptions{}
 	tx, err := db.BeginTx(ctx, txOpts)
@@ -652,7 +1757,7 @@ func execOnDBTx(sqlText, driverName, dsn string, seeds []string, conf *NyanConfi
 		return err
 	}
 
-	cleanup, roErr := enforceReadOnly(ctx, tx, driverName, readOnly)
+	cleanup, roErr := enforceReadOnly(ctx, tx, db, driverName, readOnly)
 	if roErr != nil {
 		_ = tx.Rollback()
 		return roErr
@@ -663,14 +1768,49 @@ func execOnDBTx(sqlText, driverName, dsn string, seeds []string, conf *NyanConfi
 		}
 	}()
 
+	pt.Connect = time.Since(t0)
+
+	t0 = time.Now()
+	if err := runHooks(ctx, tx, dialect, "beforeEach", hooks.BeforeEach, true); err != nil {
+		_ = tx.Rollback()
+		pt.Seed = time.Since(t0)
+		return err
+	}
 	if len(seeds) > 0 {
-		if err := execBatch(ctx, tx, strings.Join(seeds, ";\n")); err != nil {
+		seedCtx, seedCancel := context.WithTimeout(ctx, seedTimeout)
+		err := execBatch(seedCtx, tx, dialect, strings.Join(seeds, ";\n"))
+		seedCancel()
+		if err != nil {
 			_ = tx.Rollback()
+			pt.Seed = time.Since(t0)
+			if te := timeoutErr(seedCtx, "seed", seedTimeout, err); te != nil {
+				return te
+			}
 			return fmt.Errorf("seed: %w", err)
 		}
 	}
+	pt.Seed = time.Since(t0)
+
+	t0 = time.Now()
+	defer func() { pt.Exec = time.Since(t0) }()
+	execCtx, execCancel := context.WithTimeout(ctx, timeout)
+	defer execCancel()
+	if err := execSteps(execCtx, tx, dialect, steps, timeout); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if post != nil {
+		if err := post(execCtx, tx); err != nil {
+			_ = tx.Rollback()
+			if te := timeoutErr(execCtx, "statement", timeout, err); te != nil {
+				return te
+			}
+			return err
+		}
+	}
 
-	if err := execBatch(ctx, tx, sqlText); err != nil {
+	if err := runHooks(execCtx, tx, dialect, "afterEach", hooks.AfterEach, true); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
@@ -681,7 +1821,45 @@ func execOnDBTx(sqlText, driverName, dsn string, seeds []string, conf *NyanConfi
 	return tx.Rollback()
 }
 
-func enforceReadOnly(ctx context.Context, tx *sql.Tx, driverName string, enable bool) (cleanup func() error, err error) {
+// steps を順に実行する。capture した値は後の step の再レンダリング（render）に渡す
+func execSteps(ctx context.Context, tx *sql.Tx, dialect string, steps []execStep, timeout time.Duration) error {
+	vars := map[string]any{}
+	for i := range steps {
+		st := &steps[i]
+		err := func() error {
+			if st.render != nil {
+				q, err := st.render(vars)
+				if q != "" {
+					st.sql = q
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if len(st.capture) == 0 {
+				return execBatch(ctx, tx, dialect, st.sql)
+			}
+			res, rs, err := execBatchLast(ctx, tx, dialect, st.sql, captureNeedsRows(st.capture))
+			if err != nil {
+				return err
+			}
+			return applyCapture(st.capture, res, rs, vars)
+		}()
+		if err != nil {
+			if te := timeoutErr(ctx, "statement", timeout, err); te != nil {
+				err = te
+			}
+			if st.label != "" {
+				return fmt.Errorf("%s: %w", st.label, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup は commit/rollback の後に呼ばれるので、接続（sess）側で元に戻す
+func enforceReadOnly(ctx context.Context, tx *sql.Tx, sess execer, driverName string, enable bool) (cleanup func() error, err error) {
 	if !enable {
 		return nil, nil
 	}
@@ -701,7 +1879,7 @@ func enforceReadOnly(ctx context.Context, tx *sql.Tx, driverName string, enable
 			return nil, fmt.Errorf("set read-only (sqlite PRAGMA query_only=ON): %w", err)
 		}
 		return func() error {
-			_, e := tx.ExecContext(context.Background(), "PRAGMA query_only=OFF")
+			_, e := sess.ExecContext(context.Background(), "PRAGMA query_only=OFF")
 			return e
 		}, nil
 	case "duckdb":
@@ -714,27 +1892,883 @@ func enforceReadOnly(ctx context.Context, tx *sql.Tx, driverName string, enable
 	}
 }
 
-func execBatch(ctx context.Context, ex execer, batch string) error {
-	stmts := splitBySemicolon(batch)
+// バッチ内の文の実行エラー（index は空文を除いた 1 始まりの番号）
+type stmtError struct {
+	index int
+	stmt  string
+	err   error
+}
+
+func (e *stmtError) Error() string {
+	return fmt.Sprintf("statement #%d: %v", e.index, e.err)
+}
+
+func (e *stmtError) Unwrap() error { return e.err }
+
+func execBatch(ctx context.Context, ex execer, dialect, batch string) error {
+	stmts := splitBySemicolon(batch, dialect)
+	n := 0
 	for _, s := range stmts {
 		q := strings.TrimSpace(s)
 		if q == "" {
 			continue
 		}
+		n++
 		if _, err := ex.ExecContext(ctx, q); err != nil {
-			return err
+			return &stmtError{index: n, stmt: q, err: err}
 		}
 	}
 	return nil
 }
 
-func splitBySemicolon(s string) []string {
-	return strings.Split(s, ";")
+// execBatch と同じだが、最後の文の sql.Result（queryLast なら Query の結果セット）を返す
+func execBatchLast(ctx context.Context, tx *sql.Tx, dialect, batch string, queryLast bool) (sql.Result, resultSet, error) {
+	var stmts []string
+	for _, s := range splitBySemicolon(batch, dialect) {
+		if q := strings.TrimSpace(s); q != "" {
+			stmts = append(stmts, q)
+		}
+	}
+	var res sql.Result
+	for i, q := range stmts {
+		if i == len(stmts)-1 && queryLast {
+			rs, err := queryResult(ctx, tx, q, normalizeValue)
+			if err != nil {
+				return nil, resultSet{}, &stmtError{index: i + 1, stmt: q, err: err}
+			}
+			return nil, rs, nil
+		}
+		r, err := tx.ExecContext(ctx, q)
+		if err != nil {
+			return nil, resultSet{}, &stmtError{index: i + 1, stmt: q, err: err}
+		}
+		res = r
+	}
+	return res, resultSet{}, nil
 }
 
-/* ============== Template Renderer (Runner) ============== */
+// ctx が期限切れなら、どのフェーズ・何番目の文で止まったかを示すエラーを返す（それ以外は nil）
+func timeoutErr(ctx context.Context, phase string, d time.Duration, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	var se *stmtError
+	if errors.As(err, &se) {
+		return fmt.Errorf("timeout: %s phase exceeded %s while running statement #%d: %s", phase, d, se.index, abbrev(strings.Join(strings.Fields(se.stmt), " "), 80))
+	}
+	return fmt.Errorf("timeout: %s phase exceeded %s: %v", phase, d, err)
+}
 
-var (
+// ; で文に分ける（'...' / "..." / `...` とコメントの中の ; では分けない）。
+// mysql は '...' / "..." の中の \ エスケープと # コメント、
+// postgres / duckdb は $tag$...$tag$ と E'...' の中の \ エスケープも考慮する
+func splitBySemicolon(s, dialect string) []string {
+	mysql := dialect == "mysql"
+	pgLike := dialect == "postgres" || dialect == "duckdb"
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			esc := c != '`' && mysql ||
+				c == '\'' && pgLike && i > 0 && (s[i-1] == 'E' || s[i-1] == 'e') && (i == 1 || !isIdentByte(s[i-2]))
+			for i++; i < len(s) && s[i] != c; i++ {
+				if esc && s[i] == '\\' {
+					i++
+				}
+			}
+		case c == '$' && pgLike:
+			if tag := dollarTag(s, i); tag != "" {
+				if j := strings.Index(s[i+len(tag):], tag); j >= 0 {
+					i += len(tag) + j + len(tag) - 1
+				} else {
+					i = len(s)
+				}
+			}
+		case c == '#' && mysql:
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '-' && strings.HasPrefix(s[i:], "--"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(s[i:], "/*"):
+			if j := strings.Index(s[i+2:], "*/"); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(s)
+			}
+		case c == ';':
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// s[i] から始まる dollar quote の開始タグ（$$ / $tag$）。$1 などのパラメータや識別子の一部なら空
+func dollarTag(s string, i int) string {
+	if i > 0 && (isIdentByte(s[i-1]) || s[i-1] == '$') {
+		return ""
+	}
+	j := i + 1
+	if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+		return ""
+	}
+	for j < len(s) && isIdentByte(s[j]) {
+		j++
+	}
+	if j < len(s) && s[j] == '$' {
+		return s[i : j+1]
+	}
+	return ""
+}
+
+// バッチ中の最後の（空でない）文
+func lastStatement(batch, dialect string) string {
+	stmts := splitBySemicolon(batch, dialect)
+	for i := len(stmts) - 1; i >= 0; i-- {
+		if q := strings.TrimSpace(stmts[i]); q != "" {
+			return q
+		}
+	}
+	return ""
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// クエリを実行して全行を読み込む（[]byte は string に変換）
+func queryAll(ctx context.Context, q queryer, query string) (cols []string, out [][]any, err error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	cols, err = rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+		for i, v := range vals {
+			if b, ok := v.([]byte); ok {
+				vals[i] = string(b)
+			}
+		}
+		out = append(out, vals)
+	}
+	return cols, out, rows.Err()
+}
+
+/* ============== EXPLAIN plan assertions (Runner) ============== */
+
+// test.json の "plan"。true なら既定パス（expected と同じ場所の name.plan.txt）のスナップショットだけを取る
+type PlanSpec struct {
+	ForbidFullScan bool   `json:"forbidFullScan,omitempty"`
+	MustUseIndex   string `json:"mustUseIndex,omitempty"`
+	Match          string `json:"match,omitempty"`    // plan テキストが一致すべき正規表現
+	NotMatch       string `json:"notMatch,omitempty"` // plan テキストが一致してはならない正規表現
+	Snapshot       string `json:"snapshot,omitempty"` // plan テキストのスナップショット（test.json からの相対）
+
+	defaultSnapshot bool // "plan": true
+	disabled        bool // "plan": false（読み込み側で nil にする）
+}
+
+func (p *PlanSpec) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*p = PlanSpec{defaultSnapshot: true}
+		return nil
+	case "false", "null":
+		*p = PlanSpec{disabled: true}
+		return nil
+	}
+	type plain PlanSpec
+	if err := json.Unmarshal(b, (*plain)(p)); err != nil {
+		return fmt.Errorf("plan: true, false or an object expected: %w", err)
+	}
+	return nil
+}
+
+// dialect ごとのフルスキャン検出パターン（planText の出力に対して）
+var reFullScan = map[string]*regexp.Regexp{
+	"sqlite": regexp.MustCompile(`(?m)^\s*SCAN (?:TABLE )?\S+\s*$`),
+	"mysql":  regexp.MustCompile(`(?m)\btype=ALL\b`),
+	"pgx":    regexp.MustCompile(`Seq Scan`),
+	"duckdb": regexp.MustCompile(`SEQ_SCAN|TABLE_SCAN`),
+}
+
+func explainPrefix(driverName string) string {
+	if driverName == "sqlite" {
+		return "EXPLAIN QUERY PLAN "
+	}
+	return "EXPLAIN "
+}
+
+// EXPLAIN の結果を1行1ノードのテキストにする。
+// detail（sqlite）/ QUERY PLAN（postgres）/ explain_value（duckdb）列があればその列のみ、
+// 無ければ（mysql）非NULL列を "col=value" で並べる
+func planText(cols []string, rows [][]any) string {
+	pick := -1
+	for i, c := range cols {
+		switch strings.ToLower(c) {
+		case "detail", "query plan", "explain_value":
+			pick = i
+		}
+	}
+	var lines []string
+	for _, r := range rows {
+		if pick >= 0 {
+			lines = append(lines, strings.TrimRight(toString(r[pick]), " \n"))
+			continue
+		}
+		var kv []string
+		for i, c := range cols {
+			if r[i] == nil {
+				continue
+			}
+			kv = append(kv, c+"="+toString(r[i]))
+		}
+		lines = append(lines, strings.Join(kv, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func checkPlan(ctx context.Context, tx *sql.Tx, driverName, sqlText string, spec *PlanSpec) error {
+	stmt := lastStatement(sqlText, dialectName(driverName))
+	if stmt == "" {
+		return nil
+	}
+	cols, rows, err := queryAll(ctx, tx, explainPrefix(driverName)+stmt)
+	if err != nil {
+		return fmt.Errorf("explain: %w", err)
+	}
+	plan := planText(cols, rows)
+
+	var problems []string
+	if spec.ForbidFullScan {
+		if re, ok := reFullScan[driverName]; ok && re.MatchString(plan) {
+			problems = append(problems, "full table scan detected")
+		}
+	}
+	if spec.MustUseIndex != "" && !strings.Contains(strings.ToLower(plan), strings.ToLower(spec.MustUseIndex)) {
+		problems = append(problems, fmt.Sprintf("index %q not used", spec.MustUseIndex))
+	}
+	if spec.Match != "" {
+		re, err := regexp.Compile(spec.Match)
+		if err != nil {
+			return fmt.Errorf("invalid plan.match regex: %w", err)
+		}
+		if !re.MatchString(plan) {
+			problems = append(problems, fmt.Sprintf("plan does not match /%s/", spec.Match))
+		}
+	}
+	if spec.NotMatch != "" {
+		re, err := regexp.Compile(spec.NotMatch)
+		if err != nil {
+			return fmt.Errorf("invalid plan.notMatch regex: %w", err)
+		}
+		if re.MatchString(plan) {
+			problems = append(problems, fmt.Sprintf("plan matches /%s/", spec.NotMatch))
+		}
+	}
+	if len(problems) > 0 {
+		return &assertionError{kind: "Plan mismatch", msg: strings.Join(problems, "\n") + "\n--- Plan ---\n" + plan}
+	}
+	if spec.Snapshot != "" {
+		return checkSnapshot(snapshotTarget(spec.Snapshot, dialectName(driverName)), plan, "Plan")
+	}
+	return nil
+}
+
+/* ============== Result snapshots (Runner) ============== */
+
+// test.json の "result"。true なら既定パス（expected と同じ場所の name.result.json）
+type ResultSpec struct {
+	Snapshot      string   `json:"snapshot,omitempty"`
+	Ordered       *bool    `json:"ordered,omitempty"`       // false なら行の順序を無視（多重集合として比較）
+	Tolerance     float64  `json:"tolerance,omitempty"`     // 数値（float / decimal 文字列）の許容誤差
+	Timezone      string   `json:"timezone,omitempty"`      // 日時を時刻として比較（TZ なしの値はこの TZ とみなす）
+	IgnoreColumns []string `json:"ignoreColumns,omitempty"` // 比較・スナップショットから除外する列
+
+	disabled bool           // "result": false（読み込み側で nil にする）
+	loc      *time.Location // Timezone を読み込み時に解決したもの
+}
+
+func (r *ResultSpec) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*r = ResultSpec{}
+		return nil
+	case "false", "null":
+		*r = ResultSpec{disabled: true}
+		return nil
+	}
+	type plain ResultSpec
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return fmt.Errorf("result: true, false or an object expected: %w", err)
+	}
+	return nil
+}
+
+// foo.expected.sql → foo.<kind>.json（kind: result / response）
+func snapshotPathFor(expected, kind string) string {
+	base := strings.TrimSuffix(expected, filepath.Ext(expected))
+	base = strings.TrimSuffix(base, ".expected")
+	return base + "." + kind + ".json"
+}
+
+// 結果セットのスナップショット形式（列はソート済み、行は列名→値）
+type resultSet struct {
+	Columns []string         `json:"columns"`
+	Rows    []map[string]any `json:"rows"`
+}
+
+var reQueryStmt = regexp.MustCompile(`(?i)^\s*(?:\(\s*)*(SELECT|WITH|VALUES|TABLE|SHOW|PRAGMA|DESCRIBE|DESC)\b`)
+
+// 結果を返す文か（INSERT 等を Query で再実行しないための判定）
+func isQueryStmt(stmt string) bool {
+	return reQueryStmt.MatchString(stripComments(stmt))
+}
+
+// クエリを実行し、conv（値, 列の DB 型名）で値を変換した結果セットを返す
+func queryResult(ctx context.Context, q queryer, query string, conv func(v any, dbType string) any) (resultSet, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return resultSet{}, err
+	}
+	defer rows.Close()
+	cts, err := rows.ColumnTypes()
+	if err != nil {
+		return resultSet{}, err
+	}
+	// 同名列（a.id, b.id など）は name#2, name#3 ... とする
+	names := make([]string, len(cts))
+	seen := map[string]int{}
+	for i, ct := range cts {
+		n := ct.Name()
+		seen[n]++
+		if seen[n] > 1 {
+			n = fmt.Sprintf("%s#%d", n, seen[n])
+		}
+		names[i] = n
+	}
+
+	rs := resultSet{Columns: append([]string(nil), names...), Rows: []map[string]any{}}
+	sort.Strings(rs.Columns)
+	for rows.Next() {
+		vals := make([]any, len(cts))
+		ptrs := make([]any, len(cts))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return resultSet{}, err
+		}
+		row := make(map[string]any, len(cts))
+		for i, v := range vals {
+			row[names[i]] = conv(v, cts[i].DatabaseTypeName())
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, rows.Err()
+}
+
+// DB の値を JSON で型が区別できる値にする（NULL → null、整数/小数 → number、日時 → RFC3339）
+func normalizeValue(v any, dbType string) any {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		// mysql などテキストで返るドライバ向けに列型から数値へ
+		ty := strings.ToUpper(dbType)
+		switch {
+		case strings.Contains(ty, "INT"):
+			if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+				return i
+			}
+		case ty == "FLOAT" || ty == "DOUBLE" || ty == "REAL":
+			if f, err := strconv.ParseFloat(t, 64); err == nil {
+				return f
+			}
+		}
+		return t
+	case bool, int64, float64:
+		return t
+	case int:
+		return int64(t)
+	case int8:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case uint8:
+		return int64(t)
+	case uint16:
+		return int64(t)
+	case uint32:
+		return int64(t)
+	case uint64:
+		return t
+	case float32:
+		return float64(t)
+	case time.Time:
+		// 既存のスナップショットと同じ形式（TZ の違いは "timezone" で時刻として比較する）
+		return t.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+func checkResult(ctx context.Context, tx *sql.Tx, dialect, sqlText, path string, spec *ResultSpec) error {
+	stmt := lastStatement(sqlText, dialect)
+	if !isQueryStmt(stmt) {
+		return errors.New("result snapshot: the final statement is not a SELECT")
+	}
+	rs, err := queryResult(ctx, tx, stmt, normalizeValue)
+	if err != nil {
+		return fmt.Errorf("result query: %w", err)
+	}
+	rs = dropColumns(rs, spec.IgnoreColumns)
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	expText, ok, err := syncSnapshot(path, string(b), "Result")
+	if err != nil || !ok {
+		return err
+	}
+	// 比較は JSON として読み直した値同士で行う（数値は json.Number）
+	var exp, act resultSet
+	if err := decodeResultSet(expText, &exp); err != nil {
+		return fmt.Errorf("decode result snapshot %s: %w", path, err)
+	}
+	if err := decodeResultSet(string(b), &act); err != nil {
+		return err
+	}
+	exp = dropColumns(exp, spec.IgnoreColumns)
+	if d := diffResult(exp, act, spec); d != "" {
+		return &assertionError{kind: "Result mismatch", msg: d}
+	}
+	return nil
+}
+
+func decodeResultSet(s string, rs *resultSet) error {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	return dec.Decode(rs)
+}
+
+func dropColumns(rs resultSet, ignore []string) resultSet {
+	if len(ignore) == 0 {
+		return rs
+	}
+	skip := map[string]bool{}
+	for _, c := range ignore {
+		skip[c] = true
+	}
+	out := resultSet{Rows: make([]map[string]any, 0, len(rs.Rows))}
+	for _, c := range rs.Columns {
+		if !skip[c] {
+			out.Columns = append(out.Columns, c)
+		}
+	}
+	for _, r := range rs.Rows {
+		nr := make(map[string]any, len(r))
+		for k, v := range r {
+			if !skip[k] {
+				nr[k] = v
+			}
+		}
+		out.Rows = append(out.Rows, nr)
+	}
+	return out
+}
+
+/* ============== NyanQL-style JSON response (Runner) ============== */
+
+// test.json の "response"。true なら既定パス（expected と同じ場所の name.response.json）
+type ResponseSpec struct {
+	Snapshot string `json:"snapshot,omitempty"`
+
+	disabled bool // "response": false（読み込み側で nil にする）
+}
+
+func (r *ResponseSpec) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*r = ResponseSpec{}
+		return nil
+	case "false", "null":
+		*r = ResponseSpec{disabled: true}
+		return nil
+	}
+	type plain ResponseSpec
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return fmt.Errorf("response: true, false or an object expected: %w", err)
+	}
+	return nil
+}
+
+var reBinaryType = regexp.MustCompile(`(?i)BLOB|BINARY|BYTEA`)
+
+// NyanQL が API レスポンスで返すのと同じ型変換:
+// NULL → null、数値 → number、真偽 → bool、日時 → RFC3339、BLOB → base64、その他 → 文字列
+func nyanJSONValue(v any, dbType string) any {
+	switch t := v.(type) {
+	case []byte:
+		if reBinaryType.MatchString(dbType) {
+			return base64.StdEncoding.EncodeToString(t)
+		}
+		return normalizeValue(string(t), dbType)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+	return normalizeValue(v, dbType)
+}
+
+// 最後の SELECT の結果を NyanQL の JSON（オブジェクトの配列、キーはソート済み）にして比較する
+func checkResponse(ctx context.Context, tx *sql.Tx, dialect, sqlText, path string) error {
+	stmt := lastStatement(sqlText, dialect)
+	if !isQueryStmt(stmt) {
+		return errors.New("response snapshot: the final statement is not a SELECT")
+	}
+	rs, err := queryResult(ctx, tx, stmt, nyanJSONValue)
+	if err != nil {
+		return fmt.Errorf("response query: %w", err)
+	}
+	b, err := json.MarshalIndent(rs.Rows, "", "  ")
+	if err != nil {
+		return err
+	}
+	expText, ok, err := syncSnapshot(path, string(b), "Response")
+	if err != nil || !ok {
+		return err
+	}
+	// 手で編集された JSON でも比較できるよう整形し直す
+	exp, err := canonicalJSON(expText)
+	if err != nil {
+		return fmt.Errorf("decode response snapshot %s: %w", path, err)
+	}
+	if exp != string(b) {
+		return &assertionError{kind: "Response mismatch", msg: lineDiff(exp, string(b))}
+	}
+	return nil
+}
+
+func canonicalJSON(s string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	return string(b), err
+}
+
+/* ============== Column assertions (Runner) ============== */
+
+// test.json の "expectColumns" の要素。"id" または {"name": "id", "type": "INTEGER"}
+type ColumnSpec struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"` // sql.ColumnType.DatabaseTypeName()（大文字小文字は無視）
+}
+
+func (c *ColumnSpec) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*c = ColumnSpec{Name: name}
+		return nil
+	}
+	type plain ColumnSpec
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+func (c ColumnSpec) MarshalJSON() ([]byte, error) {
+	if c.Type == "" {
+		return json.Marshal(c.Name)
+	}
+	type plain ColumnSpec
+	return json.Marshal(plain(c))
+}
+
+// 最後の SELECT の列（名前・順序・型）を検査する。結果が0行でも列情報で判定できる
+func checkColumns(ctx context.Context, tx *sql.Tx, dialect, sqlText string, want []ColumnSpec) error {
+	stmt := lastStatement(sqlText, dialect)
+	if !isQueryStmt(stmt) {
+		return errors.New("expectColumns: the final statement is not a SELECT")
+	}
+	rows, err := tx.QueryContext(ctx, stmt)
+	if err != nil {
+		return fmt.Errorf("columns query: %w", err)
+	}
+	cts, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("column types: %w", err)
+	}
+
+	var exp, act []string
+	mismatch := len(cts) != len(want)
+	for i, w := range want {
+		exp = append(exp, strings.TrimSpace(w.Name+" "+strings.ToUpper(w.Type)))
+		if i >= len(cts) {
+			continue
+		}
+		if cts[i].Name() != w.Name || (w.Type != "" && !strings.EqualFold(cts[i].DatabaseTypeName(), w.Type)) {
+			mismatch = true
+		}
+	}
+	if !mismatch {
+		return nil
+	}
+	for i, ct := range cts {
+		// 型を指定していない列は型を表示しない（差分を見やすくするため）
+		if i < len(want) && want[i].Type == "" {
+			act = append(act, ct.Name())
+		} else {
+			act = append(act, strings.TrimSpace(ct.Name()+" "+ct.DatabaseTypeName()))
+		}
+	}
+	return &assertionError{kind: "Column mismatch", msg: lineDiff(strings.Join(exp, "\n"), strings.Join(act, "\n"))}
+}
+
+/* ============== Row comparison (Runner) ============== */
+
+// 期待/実際の結果セットを spec のオプションで比較し、差分テキストを返す（一致なら ""）
+func diffResult(exp, act resultSet, spec *ResultSpec) string {
+	var out []string
+	if strings.Join(exp.Columns, ",") != strings.Join(act.Columns, ",") {
+		out = append(out, "columns:", "- "+strings.Join(exp.Columns, ", "), "+ "+strings.Join(act.Columns, ", "))
+	}
+	cols := unionColumns(exp.Columns, act.Columns)
+
+	if spec.Ordered != nil && !*spec.Ordered {
+		// 多重集合として比較。tolerance があると一致が推移的でないため、
+		// 先着順ではなく最大マッチングで期待行と実際の行を対応付ける
+		expOf := matchRows(len(exp.Rows), len(act.Rows), func(i, j int) bool {
+			return rowEqual(exp.Rows[i], act.Rows[j], cols, spec)
+		})
+		matched := make([]bool, len(exp.Rows))
+		for _, i := range expOf {
+			if i >= 0 {
+				matched[i] = true
+			}
+		}
+		for i, r := range exp.Rows {
+			if !matched[i] {
+				out = append(out, "- "+rowJSON(r))
+			}
+		}
+		for j, r := range act.Rows {
+			if expOf[j] < 0 {
+				out = append(out, "+ "+rowJSON(r))
+			}
+		}
+	} else {
+		for i := 0; i < len(exp.Rows) || i < len(act.Rows); i++ {
+			switch {
+			case i >= len(act.Rows):
+				out = append(out, fmt.Sprintf("- row %d: %s", i+1, rowJSON(exp.Rows[i])))
+			case i >= len(exp.Rows):
+				out = append(out, fmt.Sprintf("+ row %d: %s", i+1, rowJSON(act.Rows[i])))
+			default:
+				for _, c := range cols {
+					ev, av := exp.Rows[i][c], act.Rows[i][c]
+					if !valueEqual(ev, av, spec) {
+						out = append(out, fmt.Sprintf("row %d, %s:", i+1, c), "- "+valueJSON(ev), "+ "+valueJSON(av))
+					}
+				}
+			}
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("rows: expected %d, actual %d (%s)\n", len(exp.Rows), len(act.Rows), describeCompare(spec)) + strings.Join(out, "\n")
+}
+
+// 二部グラフの最大マッチング（増加路法）。実際の行 j に対応する期待行の番号（無ければ -1）を返す
+func matchRows(nExp, nAct int, eq func(i, j int) bool) []int {
+	adj := make([][]int, nExp)
+	for i := range nExp {
+		for j := range nAct {
+			if eq(i, j) {
+				adj[i] = append(adj[i], j)
+			}
+		}
+	}
+	expOf := make([]int, nAct)
+	for j := range expOf {
+		expOf[j] = -1
+	}
+	var seen []bool
+	var augment func(i int) bool
+	augment = func(i int) bool {
+		for _, j := range adj[i] {
+			if seen[j] {
+				continue
+			}
+			seen[j] = true
+			if expOf[j] < 0 || augment(expOf[j]) {
+				expOf[j] = i
+				return true
+			}
+		}
+		return false
+	}
+	for i := range nExp {
+		seen = make([]bool, nAct)
+		augment(i)
+	}
+	return expOf
+}
+
+func describeCompare(spec *ResultSpec) string {
+	parts := []string{"ordered"}
+	if spec.Ordered != nil && !*spec.Ordered {
+		parts[0] = "unordered"
+	}
+	if spec.Tolerance > 0 {
+		parts = append(parts, fmt.Sprintf("tolerance %g", spec.Tolerance))
+	}
+	if spec.Timezone != "" {
+		parts = append(parts, "timezone "+spec.Timezone)
+	}
+	if len(spec.IgnoreColumns) > 0 {
+		parts = append(parts, "ignore "+strings.Join(spec.IgnoreColumns, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func unionColumns(a, b []string) []string {
+	set := map[string]struct{}{}
+	for _, c := range a {
+		set[c] = struct{}{}
+	}
+	for _, c := range b {
+		set[c] = struct{}{}
+	}
+	out := make([]string, 0, len(set))
+	for c := range set {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func rowEqual(a, b map[string]any, cols []string, spec *ResultSpec) bool {
+	for _, c := range cols {
+		if !valueEqual(a[c], b[c], spec) {
+			return false
+		}
+	}
+	return true
+}
+
+func valueEqual(e, a any, spec *ResultSpec) bool {
+	if e == nil || a == nil {
+		return e == nil && a == nil
+	}
+	es, aa := valueJSON(e), valueJSON(a)
+	if es == aa {
+		return true
+	}
+	if spec.Tolerance > 0 {
+		if ef, ok := numericValue(e); ok {
+			if af, ok := numericValue(a); ok {
+				return math.Abs(ef-af) <= spec.Tolerance
+			}
+		}
+	}
+	if spec.loc != nil {
+		if et, ok := parseTimestamp(e, spec.loc); ok {
+			if at, ok := parseTimestamp(a, spec.loc); ok {
+				return et.Equal(at)
+			}
+		}
+	}
+	// 数値同士は表記揺れ（1 と 1.0 など）を吸収
+	if ef, ok := e.(json.Number); ok {
+		if af, ok := a.(json.Number); ok {
+			x, err1 := ef.Float64()
+			y, err2 := af.Float64()
+			return err1 == nil && err2 == nil && x == y
+		}
+	}
+	return false
+}
+
+// json.Number または数値文字列（decimal など）を float64 に
+func numericValue(v any) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// 日時文字列を解釈（TZ を含まない値は loc のローカル時刻とみなす）
+func parseTimestamp(v any, loc *time.Location) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, l := range timestampLayouts {
+		if t, err := time.ParseInLocation(l, strings.TrimSpace(s), loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func rowJSON(r map[string]any) string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func valueJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+/* ============== Template Renderer (Runner) ============== */
+
+var (
 	// case-insensitive に対応（/*iF*/, /*begin*/ などもOK）
 	reBeginEnd  = regexp.MustCompile(`(?i)/\*BEGIN\*/([\s\S]*?)/\*(?:END|ENDIF|FI)\*/`)
 	reIfBlock   = regexp.MustCompile(`(?i)/\*IF\s+([^*]+?)\*/([\s\S]*?)/\*(?:END|ENDIF|FI)\*/`)
@@ -743,91 +2777,484 @@ var (
 	reParam = regexp.MustCompile(`(?i)/\*([a-zA-Z0-9_]+)\*/("([^"]*)"|'([^']*)'|[0-9.+-]+|true|false|null)`)
 	// BEGIN…END の中身が実質カラなら落とす
 	reEmptyWhere = regexp.MustCompile(`^(?:WHERE)?\s*(?:AND|OR)?\s*\(?\s*\)?$`)
+	// デフォルト値の有無に関係なく /*key*/ の形のコメント（置換漏れの検出用）
+	rePlaceholder = regexp.MustCompile(`/\*([a-zA-Z0-9_]+)\*/`)
+	reBlockWord   = regexp.MustCompile(`(?i)^(?:BEGIN|END|ENDIF|FI)$`)
 )
 
 // 処理順: 1) /*? key ?*/ → 2) /*IF ...*/ → 3) /*BEGIN..END*/ → 4) パラメータ置換 → 5) 整形
 func renderNyanSQL(tpl string, params map[string]any) (string, error) {
+	return renderNyanSQLWith(tpl, params, "", nil)
+}
+
+// ブロックの展開結果の記録先（テンプレートカバレッジ用）。line は元テンプレートでの開始行
+type blockRecorder func(kind, label string, line int, rendered bool)
+
+// renderNyanSQLWith の記録先（いずれも nil 可）
+type renderTrace struct {
+	blocks    blockRecorder   // 評価した各ブロック（OPTIONAL / IF / BEGIN）が展開されたかどうか
+	defaulted map[string]bool // params にキーが無く、デフォルト値のまま残したプレースホルダ
+	leftover  map[string]bool // 置換されずに残ったプレースホルダ（"/*d*/ (line 8)"。params にキーが無いもの）
+}
+
+// dialect（sqlite / mysql / postgres / duckdb。"" なら方言に依存しない従来の形）で文字列のエスケープを選ぶ
+func renderNyanSQLWith(tpl string, params map[string]any, dialect string, tr *renderTrace) (string, error) {
+	if tr == nil {
+		tr = &renderTrace{}
+	}
+	sqlText, lines := expandBlocks(tpl, params, false, tr.blocks)
+
+	// reParam が置換できないプレースホルダ（/*d*/CURRENT_DATE などデフォルト値が未対応のリテラル）は
+	// コメントのまま残る。params に値があるのに無視される場合はエラー、無ければ tr.leftover に記録する
+	replaced := map[int]bool{}
+	for _, m := range reParam.FindAllStringIndex(sqlText, -1) {
+		replaced[m[0]] = true
+	}
+	var ignored []string
+	for _, m := range rePlaceholder.FindAllStringSubmatchIndex(sqlText, -1) {
+		name := sqlText[m[2]:m[3]]
+		if replaced[m[0]] || reBlockWord.MatchString(name) {
+			continue
+		}
+		loc := fmt.Sprintf("/*%s*/ (line %d)", name, lines[m[0]])
+		if _, ok := params[name]; ok {
+			ignored = append(ignored, loc)
+		} else if tr.leftover != nil {
+			tr.leftover[loc] = true
+		}
+	}
+	if len(ignored) > 0 {
+		return "", fmt.Errorf("placeholder not replaced (unsupported default literal), params value ignored: %s", strings.Join(ignored, ", "))
+	}
+
+	// 4) パラメータ置換（デフォルトのクォート形式を尊重: '...' or "..."）
+	var typedErr error
+	sqlText = reParam.ReplaceAllStringFunc(sqlText, func(m string) string {
+		sm := reParam.FindStringSubmatch(m)
+		name := sm[1]
+		defWhole := sm[2]
+		if v, ok := params[name]; ok && v != nil {
+			switch vv := v.(type) {
+			case bool:
+				if vv {
+					return "true"
+				}
+				return "false"
+			case float64: // JSON number
+				if float64(int64(vv)) == vv {
+					return strconv.FormatInt(int64(vv), 10)
+				}
+				return strconv.FormatFloat(vv, 'f', -1, 64)
+			case json.Number:
+				if i, err := vv.Int64(); err == nil {
+					return strconv.FormatInt(i, 10)
+				}
+				// float64 で桁が落ちる値（大きな整数・長い小数）は書かれたまま出す
+				if f, err := vv.Float64(); err == nil {
+					if fs := strconv.FormatFloat(f, 'f', -1, 64); sameDecimal(fs, vv.String()) {
+						return fs
+					}
+				}
+				return vv.String()
+			case string:
+				return quoteLiteral(dialect, defWhole, vv)
+			case map[string]any:
+				if lit, ok, err := typedLiteral(dialect, vv); ok {
+					if err != nil && typedErr == nil {
+						typedErr = fmt.Errorf("param %s: %w", name, err)
+					}
+					return lit
+				}
+				return quoteLiteral(dialect, defWhole, toString(v))
+			default:
+				return quoteLiteral(dialect, defWhole, toString(v))
+			}
+		}
+		if _, ok := params[name]; !ok && tr.defaulted != nil {
+			tr.defaulted[name] = true
+		}
+		return defWhole
+	})
+	if typedErr != nil {
+		return "", typedErr
+	}
+
+	// 5) 整形
+	return strings.TrimSpace(normalizeWhitespace(sqlText)), nil
+}
+
+// 1)〜3) のブロック展開。all=true なら条件に関係なく全ブロックを展開する（ブロック一覧の取得用）
+// 戻り値の []int は展開後の各バイトの元テンプレートでの行番号
+func expandBlocks(tpl string, params map[string]any, all bool, rec blockRecorder) (string, []int) {
+	if rec == nil {
+		rec = func(string, string, int, bool) {}
+	}
+	keep := func(ok bool, group int) int {
+		if ok || all {
+			return group
+		}
+		return -1
+	}
+	lines := make([]int, len(tpl))
+	ln := 1
+	for i := 0; i < len(tpl); i++ {
+		lines[i] = ln
+		if tpl[i] == '\n' {
+			ln++
+		}
+	}
 	sqlText := tpl
 
 	// 1) 可変ブロック: /*? key ?*/ ... /*?*/
-	sqlText = reOptBlock.ReplaceAllStringFunc(sqlText, func(m string) string {
-		sm := reOptBlock.FindStringSubmatch(m)
-		if len(sm) < 3 {
-			return ""
-		}
+	sqlText, lines = replaceBlocks(reOptBlock, sqlText, lines, func(sm []string, line int) int {
 		key := strings.TrimSpace(sm[1])
-		body := sm[2]
-		if isTruthy(params[key]) {
-			return body
+		ok := isTruthy(params[key])
+		rec("OPTIONAL", key, line, ok)
+		return keep(ok, 2)
+	})
+
+	// 2) IF ブロック
+	sqlText, lines = replaceBlocks(reIfBlock, sqlText, lines, func(sm []string, line int) int {
+		cond := strings.TrimSpace(sm[1])
+		ok := evalCondFlexible(cond, params)
+		rec("IF", cond, line, ok)
+		return keep(ok, 2)
+	})
+
+	// 3) BEGIN…END
+	sqlText, lines = replaceBlocks(reBeginEnd, sqlText, lines, func(sm []string, line int) int {
+		only := normalizeWhitespace(stripComments(sm[1]))
+		up := strings.ToUpper(strings.TrimSpace(only))
+		ok := up != "" && !reEmptyWhere.MatchString(up)
+		rec("BEGIN", "", line, ok)
+		return keep(ok, 1)
+	})
+	return sqlText, lines
+}
+
+// re の各マッチを fn が返すサブマッチ番号の内容に置き換える（-1 なら削除）。
+// lines は s の各バイトの元テンプレートでの行番号で、置換後の文字列に合わせて返す
+func replaceBlocks(re *regexp.Regexp, s string, lines []int, fn func(sm []string, line int) int) (string, []int) {
+	idx := re.FindAllStringSubmatchIndex(s, -1)
+	if len(idx) == 0 {
+		return s, lines
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	nl := make([]int, 0, len(lines))
+	prev := 0
+	for _, m := range idx {
+		b.WriteString(s[prev:m[0]])
+		nl = append(nl, lines[prev:m[0]]...)
+		sm := make([]string, len(m)/2)
+		for i := range sm {
+			if m[2*i] >= 0 {
+				sm[i] = s[m[2*i]:m[2*i+1]]
+			}
+		}
+		if g := fn(sm, lines[m[0]]); g > 0 && m[2*g] >= 0 {
+			b.WriteString(s[m[2*g]:m[2*g+1]])
+			nl = append(nl, lines[m[2*g]:m[2*g+1]]...)
+		}
+		prev = m[1]
+	}
+	b.WriteString(s[prev:])
+	nl = append(nl, lines[prev:]...)
+	return b.String(), nl
+}
+
+/* ============== Template coverage (Runner) ============== */
+
+// 1ブロックの集計。rendered / skipped はそのブロックが展開された／落とされた回数
+type blockCov struct {
+	Line     int    `json:"line"`
+	Kind     string `json:"kind"` // OPTIONAL / IF / BEGIN
+	Label    string `json:"label,omitempty"`
+	Rendered int    `json:"rendered"`
+	Skipped  int    `json:"skipped"`
+}
+
+type fileCov struct {
+	File   string      `json:"file"`
+	Blocks []*blockCov `json:"blocks"`
+	idx    map[string]*blockCov
+}
+
+type coverageReport struct {
+	Branches int        `json:"branches"` // ブロックごとに rendered / skipped の2分岐
+	Covered  int        `json:"covered"`
+	Files    []*fileCov `json:"files"`
+}
+
+// -coverage 系フラグ指定時のみ non-nil（renderTemplate が記録する）
+var coverage *templateCoverage
+
+type templateCoverage struct {
+	files map[string]*fileCov
+}
+
+func newTemplateCoverage() *templateCoverage {
+	return &templateCoverage{files: map[string]*fileCov{}}
+}
+
+func covKey(kind, label string, line int) string {
+	return fmt.Sprintf("%d|%s|%s", line, kind, label)
+}
+
+// SQL ファイルの全ブロックを登録し（一度も評価されないブロックも未カバーとして出すため）、記録用の関数を返す
+func (c *templateCoverage) recorder(path, tpl string) blockRecorder {
+	fc, ok := c.files[path]
+	if !ok {
+		fc = &fileCov{File: displayPath(path), idx: map[string]*blockCov{}}
+		_, _ = expandBlocks(tpl, nil, true, func(kind, label string, line int, _ bool) {
+			k := covKey(kind, label, line)
+			if _, ok := fc.idx[k]; !ok {
+				bc := &blockCov{Line: line, Kind: kind, Label: label}
+				fc.idx[k] = bc
+				fc.Blocks = append(fc.Blocks, bc)
+			}
+		})
+		sort.SliceStable(fc.Blocks, func(i, j int) bool { return fc.Blocks[i].Line < fc.Blocks[j].Line })
+		c.files[path] = fc
+	}
+	return func(kind, label string, line int, rendered bool) {
+		bc, ok := fc.idx[covKey(kind, label, line)]
+		if !ok {
+			return
+		}
+		if rendered {
+			bc.Rendered++
+		} else {
+			bc.Skipped++
+		}
+	}
+}
+
+func (c *templateCoverage) report() coverageReport {
+	var r coverageReport
+	paths := make([]string, 0, len(c.files))
+	for p := range c.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fc := c.files[p]
+		for _, bc := range fc.Blocks {
+			r.Branches += 2
+			if bc.Rendered > 0 {
+				r.Covered++
+			}
+			if bc.Skipped > 0 {
+				r.Covered++
+			}
+		}
+		r.Files = append(r.Files, fc)
+	}
+	return r
+}
+
+// 集計と未カバーの分岐（file:line KIND label: never rendered / never skipped）
+func (r coverageReport) String() string {
+	var b strings.Builder
+	pct := 100.0
+	if r.Branches > 0 {
+		pct = float64(r.Covered) * 100 / float64(r.Branches)
+	}
+	fmt.Fprintf(&b, "Template coverage: %d/%d branches (%.1f%%)\n", r.Covered, r.Branches, pct)
+	for _, fc := range r.Files {
+		for _, bc := range fc.Blocks {
+			var miss []string
+			if bc.Rendered == 0 {
+				miss = append(miss, "never rendered")
+			}
+			if bc.Skipped == 0 {
+				miss = append(miss, "never skipped")
+			}
+			if len(miss) > 0 {
+				fmt.Fprintf(&b, "  %s:%d %s: %s\n", fc.File, bc.Line, strings.TrimSpace(bc.Kind+" "+bc.Label), strings.Join(miss, ", "))
+			}
+		}
+	}
+	return b.String()
+}
+
+// lcov 形式（BRDA: 行, ブロック番号, 分岐 0=rendered / 1=skipped, 回数）
+func (r coverageReport) lcov() string {
+	var b strings.Builder
+	for _, fc := range r.Files {
+		fmt.Fprintf(&b, "TN:\nSF:%s\n", fc.File)
+		hit := 0
+		for i, bc := range fc.Blocks {
+			fmt.Fprintf(&b, "BRDA:%d,%d,0,%d\n", bc.Line, i, bc.Rendered)
+			fmt.Fprintf(&b, "BRDA:%d,%d,1,%d\n", bc.Line, i, bc.Skipped)
+			hit += min(bc.Rendered, 1) + min(bc.Skipped, 1)
+		}
+		fmt.Fprintf(&b, "BRF:%d\nBRH:%d\n", len(fc.Blocks)*2, hit)
+		lines := map[int]int{}
+		var order []int
+		for _, bc := range fc.Blocks {
+			if _, ok := lines[bc.Line]; !ok {
+				order = append(order, bc.Line)
+			}
+			lines[bc.Line] += bc.Rendered + bc.Skipped
+		}
+		lh := 0
+		for _, ln := range order {
+			fmt.Fprintf(&b, "DA:%d,%d\n", ln, lines[ln])
+			if lines[ln] > 0 {
+				lh++
+			}
+		}
+		fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", len(order), lh)
+	}
+	return b.String()
+}
+
+// カレントディレクトリからの相対パス（できなければそのまま）
+func displayPath(p string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if r, err := filepath.Rel(wd, p); err == nil && !strings.HasPrefix(r, "..") {
+			return filepath.ToSlash(r)
+		}
+	}
+	return filepath.ToSlash(p)
+}
+
+func writeCoverage(jsonPath, lcovPath string, r coverageReport) error {
+	if jsonPath != "" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(jsonPath), 0o755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := os.WriteFile(jsonPath, append(b, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	if lcovPath != "" {
+		if err := os.MkdirAll(filepath.Dir(lcovPath), 0o755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := os.WriteFile(lcovPath, []byte(r.lcov()), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// デフォルト値のクォート形式と方言に合わせて値をリテラルにする。
+// '...' は、mysql なら \ も \\ にエスケープ（既定の sql_mode）、postgres なら \ を含むとき E'...'、
+// sqlite / duckdb なら NUL を含むとき ('a' || char(0) || 'b') の形にする。
+// "..." は識別子として扱い、mysql ではバッククォートにする
+func quoteLiteral(dialect, defWhole, s string) string {
+	if strings.HasPrefix(defWhole, `"`) {
+		if dialect == "mysql" {
+			return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+		}
+		return quoteByDefault(defWhole, s)
+	}
+	switch dialect {
+	case "mysql":
+		r := strings.NewReplacer(`\`, `\\`, `'`, `''`, "\x00", `\0`)
+		return "'" + r.Replace(s) + "'"
+	case "postgres":
+		if strings.Contains(s, `\`) {
+			return "E'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `'`, `''`) + "'"
+		}
+	case "sqlite", "duckdb":
+		if strings.Contains(s, "\x00") {
+			fn := "char(0)"
+			if dialect == "duckdb" {
+				fn = "chr(0)"
+			}
+			parts := strings.Split(s, "\x00")
+			for i, p := range parts {
+				parts[i] = quoteByDefault(defWhole, p)
+			}
+			return "(" + strings.Join(parts, " || "+fn+" || ") + ")"
+		}
+	}
+	return quoteByDefault(defWhole, s)
+}
+
+// 型付きの params（{"$date": "2025-01-01"} など。キーが1つのオブジェクト）をリテラルにする。
+// 型付きでなければ ok=false
+//   - $date      : DATE '2025-01-01'（sqlite と方言なしは '2025-01-01'）
+//   - $timestamp : TIMESTAMP '2025-01-01 10:00:00'（TZ 付きは UTC に変換。sqlite と方言なしは文字列）
+//   - $decimal   : 12345678901234567890.01（float64 を通さずそのまま）
+//   - $bytes     : base64 → X'6869'（postgres は '\x6869'::bytea、duckdb は '\x68\x69'::BLOB）
+//   - $raw       : そのまま埋め込む（CURRENT_TIMESTAMP など）
+func typedLiteral(dialect string, v map[string]any) (lit string, ok bool, err error) {
+	if len(v) != 1 {
+		return "", false, nil
+	}
+	var kind string
+	var val any
+	for k, x := range v {
+		kind, val = k, x
+	}
+	s, isStr := val.(string)
+	switch kind {
+	case "$date", "$timestamp", "$decimal", "$bytes", "$raw":
+		if !isStr {
+			return "", true, fmt.Errorf("%s expects a string", kind)
+		}
+	default:
+		return "", false, nil
+	}
+	typed := func(typ, body string) string {
+		if dialect == "" || dialect == "sqlite" {
+			return "'" + body + "'"
 		}
-		return ""
-	})
-
-	// 2) IF ブロック
-	sqlText = reIfBlock.ReplaceAllStringFunc(sqlText, func(m string) string {
-		sm := reIfBlock.FindStringSubmatch(m)
-		if len(sm) < 3 {
-			return ""
+		return typ + " '" + body + "'"
+	}
+	switch kind {
+	case "$date":
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return "", true, fmt.Errorf("invalid $date %q (YYYY-MM-DD)", s)
 		}
-		cond := strings.TrimSpace(sm[1])
-		body := sm[2]
-		if evalCondFlexible(cond, params) {
-			return body
+		return typed("DATE", s), true, nil
+	case "$timestamp":
+		t, ok := parseTimestamp(s, time.UTC)
+		if !ok {
+			return "", true, fmt.Errorf("invalid $timestamp %q", s)
 		}
-		return ""
-	})
-
-	// 3) BEGIN…END
-	sqlText = reBeginEnd.ReplaceAllStringFunc(sqlText, func(m string) string {
-		sm := reBeginEnd.FindStringSubmatch(m)
-		if len(sm) < 2 {
-			return ""
+		return typed("TIMESTAMP", t.UTC().Format("2006-01-02 15:04:05.999999")), true, nil
+	case "$decimal":
+		if !reDecimal.MatchString(s) {
+			return "", true, fmt.Errorf("invalid $decimal %q", s)
 		}
-		inner := sm[1]
-		only := normalizeWhitespace(stripComments(inner))
-		up := strings.ToUpper(strings.TrimSpace(only))
-		if up == "" || reEmptyWhere.MatchString(up) {
-			return ""
+		return s, true, nil
+	case "$bytes":
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", true, fmt.Errorf("invalid $bytes (base64): %w", err)
 		}
-		return inner
-	})
-
-	// 4) パラメータ置換（デフォルトのクォート形式を尊重: '...' or "..."）
-	sqlText = reParam.ReplaceAllStringFunc(sqlText, func(m string) string {
-		sm := reParam.FindStringSubmatch(m)
-		name := sm[1]
-		defWhole := sm[2]
-		if v, ok := params[name]; ok && v != nil {
-			switch vv := v.(type) {
-			case bool:
-				if vv {
-					return "true"
-				}
-				return "false"
-			case float64: // JSON number
-				if float64(int64(vv)) == vv {
-					return strconv.FormatInt(int64(vv), 10)
-				}
-				return strconv.FormatFloat(vv, 'f', -1, 64)
-			case json.Number:
-				if i, err := vv.Int64(); err == nil {
-					return strconv.FormatInt(i, 10)
-				}
-				if f, err := vv.Float64(); err == nil {
-					return strconv.FormatFloat(f, 'f', -1, 64)
-				}
-				return vv.String()
-			case string:
-				return quoteByDefault(defWhole, vv)
-			default:
-				return quoteByDefault(defWhole, toString(v))
+		h := fmt.Sprintf("%X", b)
+		switch dialect {
+		case "postgres":
+			return `'\x` + h + `'::bytea`, true, nil
+		case "duckdb":
+			var sb strings.Builder
+			for _, c := range b {
+				fmt.Fprintf(&sb, `\x%02X`, c)
 			}
+			return "'" + sb.String() + "'::BLOB", true, nil
 		}
-		return defWhole
-	})
+		return "X'" + h + "'", true, nil
+	}
+	return s, true, nil // $raw
+}
 
-	// 5) 整形
-	return strings.TrimSpace(normalizeWhitespace(sqlText)), nil
+var reDecimal = regexp.MustCompile(`^[+-]?(?:\d+\.?\d*|\.\d+)(?:[eE][+-]?\d+)?$`)
+
+// 2つの10進表記が同じ値か（桁落ちの判定用）
+func sameDecimal(a, b string) bool {
+	ra, ok1 := new(big.Rat).SetString(a)
+	rb, ok2 := new(big.Rat).SetString(b)
+	return ok1 && ok2 && ra.Cmp(rb) == 0
 }
 
 func quoteByDefault(defWhole, s string) string {
@@ -870,45 +3297,12 @@ func isTruthy(v any) bool {
 //   /*IF key == 'x'*/ / != 'x' // 文字列（' or " で囲む）
 //   /*IF key == 123*/          // 数値
 func evalCondFlexible(cond string, params map[string]any) bool {
-	c := strings.TrimSpace(cond)
-	if !strings.ContainsAny(c, " =!<>") {
-		return isTruthy(params[c])
-	}
-	var op string
-	if strings.Contains(c, "==") {
-		op = "=="
-	} else if strings.Contains(c, "!=") {
-		op = "!="
-	} else {
-		return false
-	}
-	parts := strings.SplitN(c, op, 2)
-	if len(parts) != 2 {
+	lhs, op, rhsV, err := parseCond(cond)
+	if err != nil {
 		return false
 	}
-	lhs := strings.TrimSpace(parts[0])
-	rhs := strings.TrimSpace(parts[1])
-
-	var rhsV any
-	switch {
-	case strings.EqualFold(rhs, "null"):
-		rhsV = nil
-	case strings.EqualFold(rhs, "true"):
-		rhsV = true
-	case strings.EqualFold(rhs, "false"):
-		rhsV = false
-	case (strings.HasPrefix(rhs, "'") && strings.HasSuffix(rhs, "'")) ||
-		(strings.HasPrefix(rhs, `"`) && strings.HasSuffix(rhs, `"`)):
-		unq := rhs[1 : len(rhs)-1]
-		rhsV = strings.ReplaceAll(strings.ReplaceAll(unq, `''`, `'`), `""`, `"`)
-	default:
-		if i, err := strconv.ParseInt(rhs, 10, 64); err == nil {
-			rhsV = i
-		} else if f, err := strconv.ParseFloat(rhs, 64); err == nil {
-			rhsV = f
-		} else {
-			return false
-		}
+	if op == "" {
+		return isTruthy(params[lhs])
 	}
 
 	lv, exists := params[lhs]
@@ -961,11 +3355,555 @@ func evalCondFlexible(cond string, params map[string]any) bool {
 	case "!=":
 		return !eq(lv, rhsV)
 	}
-	return false
+	return false
+}
+
+// IF 条件を 左辺 / 演算子（"" なら truthy 判定）/ 右辺の値 に分解する。
+// 評価できない条件（==/!= 以外の演算子、解釈できない右辺）はエラー
+func parseCond(cond string) (lhs, op string, rhs any, err error) {
+	c := strings.TrimSpace(cond)
+	if !strings.ContainsAny(c, " =!<>") {
+		return c, "", nil, nil
+	}
+	if strings.Contains(c, "==") {
+		op = "=="
+	} else if strings.Contains(c, "!=") {
+		op = "!="
+	} else {
+		return "", "", nil, fmt.Errorf("unsupported condition %q (only `key`, `key == v` and `key != v`)", c)
+	}
+	parts := strings.SplitN(c, op, 2)
+	lhs = strings.TrimSpace(parts[0])
+	r := strings.TrimSpace(parts[1])
+
+	switch {
+	case strings.EqualFold(r, "null"):
+		rhs = nil
+	case strings.EqualFold(r, "true"):
+		rhs = true
+	case strings.EqualFold(r, "false"):
+		rhs = false
+	case len(r) >= 2 && ((strings.HasPrefix(r, "'") && strings.HasSuffix(r, "'")) ||
+		(strings.HasPrefix(r, `"`) && strings.HasSuffix(r, `"`))):
+		unq := r[1 : len(r)-1]
+		rhs = strings.ReplaceAll(strings.ReplaceAll(unq, `''`, `'`), `""`, `"`)
+	default:
+		if i, err := strconv.ParseInt(r, 10, 64); err == nil {
+			rhs = i
+		} else if f, err := strconv.ParseFloat(r, 64); err == nil {
+			rhs = f
+		} else {
+			return "", "", nil, fmt.Errorf("cannot parse right-hand side %q (null / true / false / 'string' / number)", r)
+		}
+	}
+	return lhs, op, rhs, nil
+}
+
+/* ============== Syntax check without DB (Runner) ============== */
+
+// -syntax-check で使うインメモリ DB とエンジン名（main で開く）
+var (
+	syntaxDB  *sql.DB
+	syntaxEng string
+)
+
+// 構文チェックに使うエンジン。postgres / duckdb は duckdb（PostgreSQL 系のパーサ）、sqlite は sqlite。
+// mysql などパーサを持たない方言は、正しい SQL でも構文エラーになり得るので -syntax-db の明示を求める
+func syntaxEngine(dialect string) (string, error) {
+	if e := strings.ToLower(strings.TrimSpace(syntaxDBOpt)); e != "" {
+		return e, nil
+	}
+	switch dialect {
+	case "postgres", "duckdb":
+		return "duckdb", nil
+	case "sqlite":
+		return "sqlite", nil
+	}
+	return "", fmt.Errorf("-syntax-check: no in-memory engine parses %s SQL (INSERT IGNORE, ON DUPLICATE KEY UPDATE, # comments... would be reported as syntax errors); pass -syntax-db sqlite|duckdb explicitly to check it anyway", dialect)
+}
+
+// インメモリ DB を開き、-syntax-schema（ファイル、またはディレクトリ内の *.sql を名前順）を流す。
+// このエンジンで通らない DDL（方言の違い）は飛ばし、件数と最初のエラーを stderr に出す
+func openSyntaxDB(engine, dialect, schema string) (*sql.DB, error) {
+	if engine != "sqlite" && engine != "duckdb" {
+		return nil, fmt.Errorf("-syntax-db: unsupported engine %q (sqlite|duckdb)", engine)
+	}
+	db, err := sql.Open(engine, ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // :memory: は接続ごとに別 DB になるため
+	if schema == "" {
+		return db, nil
+	}
+	var files []string
+	if info, err := os.Stat(schema); err != nil {
+		db.Close()
+		return nil, err
+	} else if info.IsDir() {
+		err := filepath.Walk(schema, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(strings.ToLower(p), ".sql") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		sort.Strings(files)
+	} else {
+		files = []string{schema}
+	}
+	skipped := 0
+	var firstErr error
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		for _, s := range splitBySemicolon(string(b), dialect) {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			if _, err := db.Exec(s); err != nil {
+				skipped++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", f, err)
+				}
+			}
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "note: -syntax-schema: %d statement(s) skipped on %s (first: %v)\n", skipped, engine, firstErr)
+	}
+	return db, nil
+}
+
+// レンダリング結果を文ごとに Prepare して構文エラーだけを失敗にする
+// （テーブルが無い・関数が無いなどのエラーは方言の違いもあるため対象外）。
+// sqlite ドライバの Prepare は SQL をコンパイルしないため、EXPLAIN で代用する
+func checkSyntax(db *sql.DB, engine, dialect string, steps []execStep) error {
+	prepare := func(q string) error {
+		if engine == "sqlite" {
+			rows, err := db.QueryContext(context.Background(), "EXPLAIN "+q)
+			if err != nil {
+				return err
+			}
+			return rows.Close()
+		}
+		stmt, err := db.PrepareContext(context.Background(), q)
+		if err != nil {
+			return err
+		}
+		return stmt.Close()
+	}
+	var fails []string
+	for _, st := range steps {
+		n := 0
+		for _, s := range splitBySemicolon(st.sql, dialect) {
+			q := strings.TrimSpace(s)
+			if q == "" {
+				continue
+			}
+			n++
+			err := prepare(q)
+			if err == nil || !isSyntaxError(err) {
+				continue
+			}
+			where := fmt.Sprintf("statement #%d", n)
+			if st.label != "" {
+				where = st.label + ": " + where
+			}
+			fails = append(fails, fmt.Sprintf("%s: %v\n  %s", where, err, abbrev(q, 200)))
+		}
+	}
+	if len(fails) == 0 {
+		return nil
+	}
+	return &assertionError{kind: "Syntax error", msg: strings.Join(fails, "\n")}
+}
+
+/* ============== Injection probes (Runner) ============== */
+
+// -fuzz-injection で文字列 params に入れる値（クォート、バックスラッシュ、コメント、NUL、Unicode のクォートなど）
+var injectionProbes = []string{
+	`'`,
+	`' OR '1'='1`,
+	`'; DROP TABLE nyantest_probe; --`,
+	`"`,
+	`" OR "1"="1`,
+	`\`,
+	`abc\`,
+	`\'`,
+	`\' OR 1=1 -- `,
+	`\\'`,
+	`-- comment`,
+	`/* comment`,
+	`*/`,
+	`# comment`,
+	"a\x00b",
+	"’ OR ’1’=’1",
+	"＇",
+	"ʼ",
+	"x\n;SELECT 1",
+	`$$`,
+	`%_`,
+}
+
+// 文字列 params の1つずつに injectionProbes を入れてレンダリング（と実行）し、
+// 文の構造（トークン列）が変わる、または DB が構文エラーを返したら失敗にする。
+// 比較の基準は同じキーに無害な文字列を入れたもの（IF 条件で分岐が変わる影響を除くため）。
+// steps のテストは step ごとの params を対象にし、実行は全 step を通して行う
+func probeInjection(tc TestCase, drvName, effDSN string, conf *NyanConfig) error {
+	dialect := dialectName(drvName)
+	// 単一SQLのテストも1つの step として扱う
+	tsteps := tc.Steps
+	if len(tsteps) == 0 {
+		tsteps = []TestStep{{SQLPath: tc.SQLPath, ParamsPath: tc.ParamsPath, ParamsInline: tc.ParamsInline}}
+	}
+	params := make([]map[string]any, len(tsteps))
+	for i, st := range tsteps {
+		tplBytes, err := os.ReadFile(st.SQLPath)
+		if err != nil {
+			return fmt.Errorf("read sql: %w", err)
+		}
+		if params[i], err = loadParams(st.ParamsPath, st.ParamsInline, string(tplBytes)); err != nil {
+			return err
+		}
+	}
+
+	// step i を params p でレンダリングする（capture より後の step は実行時に再レンダリング）
+	render := func(i int, p map[string]any) (execStep, error) {
+		st := tsteps[i]
+		q, err := renderTemplate(st.SQLPath, "", p, nil, dialect, nil)
+		es := execStep{sql: q, capture: st.Capture}
+		if len(tc.Steps) > 0 {
+			es.label = stepLabel(i, st)
+		}
+		for _, prev := range tsteps[:i] {
+			if len(prev.Capture) > 0 {
+				es.render = func(vars map[string]any) (string, error) {
+					return renderTemplate(st.SQLPath, "", p, vars, dialect, nil)
+				}
+				break
+			}
+		}
+		return es, err
+	}
+	plain := make([]execStep, len(tsteps))
+	for i := range tsteps {
+		es, err := render(i, params[i])
+		if err != nil {
+			return err
+		}
+		plain[i] = es
+	}
+	// step k の key に val を入れた steps（他の step はそのまま）
+	with := func(k int, key, val string) ([]execStep, error) {
+		p := maps.Clone(params[k])
+		p[key] = val
+		es, err := render(k, p)
+		if err != nil {
+			return nil, err
+		}
+		steps := slices.Clone(plain)
+		steps[k] = es
+		return steps, nil
+	}
+
+	// 構造の比較（DB なし）。変わらなかったものだけを実行して構文エラーを見る
+	type probeRun struct {
+		id    string // step と key（基準が構文エラーなら、同じ id のプローブは実行結果で判定しない）
+		probe string // 空なら基準
+		steps []execStep
+	}
+	var runs []probeRun
+	var fails []string
+	for k := range tsteps {
+		var keys []string
+		for key, v := range params[k] {
+			if _, ok := v.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			id := key
+			if len(tc.Steps) > 0 {
+				id = stepLabel(k, tsteps[k]) + ": " + key
+			}
+			base, err := with(k, key, "nyantest_probe")
+			if err != nil {
+				return err
+			}
+			// NUL は方言によって ('a' || char(0) || 'b') の形になるため、基準も NUL を含む値にする
+			baseNUL, err := with(k, key, "nyantest\x00probe")
+			if err != nil {
+				return err
+			}
+			runs = append(runs, probeRun{id: id, steps: base})
+			for _, probe := range injectionProbes {
+				steps, err := with(k, key, probe)
+				if err != nil {
+					return err
+				}
+				want := sqlShape(base[k].sql, dialect)
+				if strings.Contains(probe, "\x00") {
+					want = sqlShape(baseNUL[k].sql, dialect)
+				}
+				if got := sqlShape(steps[k].sql, dialect); !slices.Equal(got, want) {
+					fails = append(fails, fmt.Sprintf("%s=%q: statement structure changed\n  %s", id, probe, abbrev(steps[k].sql, 200)))
+					continue
+				}
+				runs = append(runs, probeRun{id: id, probe: probe, steps: steps})
+			}
+		}
+	}
+
+	if !noexec {
+		seeds, err := loadSeeds(tc)
+		if err != nil {
+			return err
+		}
+		timeout := time.Duration(firstPositive(tc.Timeout, timeoutSec)) * time.Second
+		seedTimeout := time.Duration(firstPositive(tc.SeedTimeout, seedTimeoutSec, tc.Timeout, timeoutSec)) * time.Second
+		// フックと seed はテストごとに1回だけ実行し、各プローブは SAVEPOINT で戻す。
+		// duckdb は SAVEPOINT が無く、エラーでトランザクションが使えなくなるので、エラーのあとだけやり直す
+		savepoint := dialect != "duckdb"
+		errRestart := errors.New("restart probe transaction")
+		baseBroken := map[string]bool{}
+		todo := runs
+		for len(todo) > 0 {
+			err := execOnDBTx(nil, drvName, effDSN, seeds, testHooks, conf, seedTimeout, timeout*time.Duration(len(todo)), false, readOnly,
+				func(ctx context.Context, tx *sql.Tx) error {
+					for len(todo) > 0 {
+						r := todo[0]
+						todo = todo[1:]
+						// 無害な値でも構文エラーになる場合（分岐の組み合わせの問題）は実行結果では判定しない
+						if baseBroken[r.id] {
+							continue
+						}
+						if savepoint {
+							if _, err := tx.ExecContext(ctx, "SAVEPOINT nyantest_probe"); err != nil {
+								return fmt.Errorf("probe savepoint: %w", err)
+							}
+						}
+						pctx, cancel := context.WithTimeout(ctx, timeout)
+						err := execSteps(pctx, tx, dialect, r.steps, timeout)
+						cancel()
+						if savepoint {
+							for _, q := range []string{"ROLLBACK TO SAVEPOINT nyantest_probe", "RELEASE SAVEPOINT nyantest_probe"} {
+								if _, rerr := tx.ExecContext(ctx, q); rerr != nil {
+									return fmt.Errorf("probe savepoint: %w", rerr)
+								}
+							}
+						}
+						if err != nil && isSyntaxError(err) {
+							if r.probe == "" {
+								baseBroken[r.id] = true
+							} else {
+								fails = append(fails, fmt.Sprintf("%s=%q: syntax error: %v", r.id, r.probe, err))
+							}
+						}
+						if err != nil && !savepoint {
+							return errRestart
+						}
+					}
+					return nil
+				}, nil)
+			if err != nil && !errors.Is(err, errRestart) {
+				return err
+			}
+		}
+	}
+
+	if len(fails) == 0 {
+		return nil
+	}
+	return &assertionError{
+		kind: "Injection probe failed",
+		msg:  fmt.Sprintf("%d probe(s) failed\n%s", len(fails), strings.Join(fails, "\n")),
+	}
+}
+
+// DB の構文エラー（制約違反や型変換エラーなどは対象外）
+func isSyntaxError(err error) bool {
+	m := strings.ToLower(err.Error())
+	for _, s := range []string{"syntax error", "error in your sql syntax", "unterminated", "unrecognized token", "incomplete input", "parser error"} {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SQL をトークンの種類の列にする（文字列リテラルの中身は区別しない）。
+// mysql は '...' / "..." の中の \ をエスケープとして扱い、# もコメントにする
+func sqlShape(q, dialect string) []string {
+	var out []string
+	backslash := dialect == "mysql"
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '-' && strings.HasPrefix(q[i:], "--") || c == '#' && backslash:
+			j := strings.IndexByte(q[i:], '\n')
+			if j < 0 {
+				j = len(q) - i
+			}
+			out = append(out, "comment")
+			i += j
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			j := strings.Index(q[i+2:], "*/")
+			if j < 0 {
+				return append(out, "unterminated comment")
+			}
+			out = append(out, "comment")
+			i += j + 4
+		case c == '\'' || c == '"' || c == '`':
+			// postgres の E'...' は \ をエスケープとして扱う
+			esc := backslash && c != '`' || c == '\'' && dialect == "postgres" && i > 0 && (q[i-1] == 'E' || q[i-1] == 'e')
+			j := i + 1
+			closed := false
+			for j < len(q) {
+				if esc && q[j] == '\\' {
+					j += 2
+					continue
+				}
+				if q[j] == c {
+					if j+1 < len(q) && q[j+1] == c {
+						j += 2
+						continue
+					}
+					closed = true
+					j++
+					break
+				}
+				j++
+			}
+			if !closed {
+				return append(out, "unterminated "+string(c))
+			}
+			kind := "string"
+			if c != '\'' && !backslash || c == '`' {
+				kind = "ident"
+			}
+			out = append(out, kind)
+			i = j
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= 0x80:
+			j := i
+			for j < len(q) && (q[j] == '_' || q[j] == '$' || q[j] >= '0' && q[j] <= '9' || q[j] >= 'A' && q[j] <= 'Z' || q[j] >= 'a' && q[j] <= 'z' || q[j] >= 0x80) {
+				j++
+			}
+			w := strings.ToUpper(q[i:j])
+			if j < len(q) && q[j] == '\'' && (w == "E" || w == "N" || w == "X" || w == "B") {
+				i = j // E'...' などの接頭辞は文字列の一部
+				continue
+			}
+			out = append(out, "word:"+w)
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.') {
+				j++
+			}
+			out = append(out, "number")
+			i = j
+		default:
+			out = append(out, string(c))
+			i++
+		}
+	}
+	return out
+}
+
+/* ============== Comparison Helpers (Runner) ============== */
+
+// テキストスナップショット（plan など）の生成・更新・比較。
+// 無ければ -auto-expected で生成、-snapshot-update で上書き、それ以外は行単位で比較
+func checkSnapshot(path, actual, kind string) error {
+	expected, ok, err := syncSnapshot(path, actual, kind)
+	if err != nil || !ok {
+		return err
+	}
+	if strings.TrimSpace(expected) != strings.TrimSpace(actual) {
+		return &assertionError{kind: kind + " mismatch", msg: lineDiff(expected, actual)}
+	}
+	return nil
+}
+
+// スナップショットの生成/更新を行い、比較対象の既存内容を返す（生成/更新した場合は ok=false）
+func syncSnapshot(path, actual, kind string) (expected string, ok bool, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("read %s snapshot: %w", strings.ToLower(kind), err)
+	}
+	if (os.IsNotExist(err) && (autoExpected || (snapshotUpdate && dialectExp))) || (err == nil && snapshotUpdate) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", false, fmt.Errorf("make %s snapshot dir: %w", strings.ToLower(kind), err)
+		}
+		if err := writeSnapshotFile(path, actual); err != nil {
+			return "", false, fmt.Errorf("write %s snapshot: %w", strings.ToLower(kind), err)
+		}
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("%s snapshot not found: %s (use -auto-expected)", strings.ToLower(kind), path)
+	}
+	return string(b), true, nil
+}
+
+// 行単位の差分（LCS）。一致行は "  "、期待のみ "- "、実際のみ "+ "
+func lineDiff(expected, actual string) string {
+	a := strings.Split(strings.TrimSpace(expected), "\n")
+	b := strings.Split(strings.TrimSpace(actual), "\n")
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return strings.Join(out, "\n")
 }
 
-/* ============== Comparison Helpers (Runner) ============== */
-
 func normalizeForCompare(s string) string {
 	s = stripComments(s)
 	reSpace := regexp.MustCompile(`\s+`)
@@ -988,6 +3926,52 @@ func diff(expected, actual string) string {
 	return "- " + e + "\n+ " + a
 }
 
+/* ============== Environment variables ============== */
+
+var reEnvVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ${VAR} / ${VAR:-default} を環境変数で展開する（:- は未定義または空のとき default）。
+// 既定値のない未定義の変数は、リテラルのまま残さずまとめてエラーにする。
+// inJSON=true なら値（default も）を JSON 文字列の中に埋め込めるようエスケープする
+func expandEnv(s string, inJSON bool) (string, error) {
+	var missing []string
+	out := reEnvVar.ReplaceAllStringFunc(s, func(m string) string {
+		sm := reEnvVar.FindStringSubmatch(m)
+		v, ok := os.LookupEnv(sm[1])
+		if sm[2] != "" && v == "" {
+			v, ok = sm[3], true
+		}
+		if !ok {
+			if !slices.Contains(missing, sm[1]) {
+				missing = append(missing, sm[1])
+			}
+			return m
+		}
+		if inJSON {
+			b, _ := json.Marshal(v)
+			v = string(b[1 : len(b)-1])
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return s, fmt.Errorf("undefined environment variable(s): %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// test.json を読み、${ENV} を展開する（config と同じく、コメント内は展開しない）
+func readTestJSON(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := expandEnv(stripTrailingCommas(stripJSONC(string(b))), true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return []byte(s), nil
+}
+
 /* ============== JSONC utils (shared) ============== */
 
 func decodeParams(b []byte) (map[string]any, error) {
@@ -1097,26 +4081,64 @@ func stripTrailingCommas(s string) string {
 	return out.String()
 }
 
+/* ============== Dialect-specific expected (Runner) ============== */
+
+// foo.expected.sql → foo.expected.<dialect>.sql
+func dialectExpectedPath(p, dialect string) string {
+	if dialect == "" {
+		return p
+	}
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "." + dialect + ext
+}
+
+// dialect 別 expected が存在すればそれを、無ければ共通の expected を返す
+func resolveExpectedPath(p, dialect string) string {
+	if dialect == "" {
+		return p
+	}
+	dp := dialectExpectedPath(p, dialect)
+	if _, err := os.Stat(dp); err == nil {
+		return dp
+	}
+	return p
+}
+
+// 比較/生成に使うスナップショット（expected / plan / result）のパス。
+// -expected-dialect で生成・更新する場合は常に dialect 別ファイル
+func snapshotTarget(p, dialect string) string {
+	if dialectExp && (autoExpected || snapshotUpdate) {
+		return dialectExpectedPath(p, dialect)
+	}
+	return resolveExpectedPath(p, dialect)
+}
+
 /* ============== test.json loader (Runner) ============== */
 
 func loadTests(path, cfgDir string) ([]TestCase, error) {
-	b, err := os.ReadFile(path)
+	b, err := readTestJSON(path)
 	if err != nil {
 		return nil, err
 	}
-	var raw map[string]map[string]any
+	var raw map[string]any
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return nil, fmt.Errorf("invalid test.json: %w", err)
 	}
 	names := make([]string, 0, len(raw))
 	for k := range raw {
+		if isHookKey(k) {
+			continue
+		}
 		names = append(names, k)
 	}
 	sort.Strings(names)
 
 	out := make([]TestCase, 0, len(raw))
 	for _, name := range names {
-		v := raw[name]
+		v, ok := raw[name].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("test '%s' must be an object", name)
+		}
 		tc := TestCase{Name: name}
 
 		tc.SQLPath = pickString(v, "sql")
@@ -1155,16 +4177,112 @@ func loadTests(path, cfgDir string) ([]TestCase, error) {
 		if tc.ActualOut == "" {
 			tc.ActualOut = pickString(v, "out")
 		}
+		tc.MaxDuration = pickInt(v, "maxDurationMs")
+		tc.SkipReason = strings.TrimSpace(pickString(v, "skip"))
+		tc.Skip = tc.SkipReason != ""
+		if b, ok := v["skip"].(bool); ok {
+			tc.Skip = b
+		}
+		if b, ok := v["todo"].(bool); ok {
+			tc.Todo = b
+		}
+		for key, dst := range map[string]*[]string{"drivers": &tc.Drivers, "skipDrivers": &tc.SkipDrivers} {
+			if p, ok := v[key]; ok && p != nil {
+				if err := remarshal(p, dst); err != nil {
+					return nil, fmt.Errorf("test '%s' has invalid '%s' (array of driver names expected): %w", name, key, err)
+				}
+			}
+		}
+		tc.Timeout = pickInt(v, "timeoutSec")
+		tc.SeedTimeout = pickInt(v, "seedTimeoutSec")
+
+		if p, ok := v["steps"]; ok && p != nil {
+			steps, err := loadSteps(p, cfgDir, tc)
+			if err != nil {
+				return nil, fmt.Errorf("test '%s' has invalid 'steps': %w", name, err)
+			}
+			if tc.SQLPath != "" || tc.Expected != "" {
+				return nil, fmt.Errorf("test '%s' cannot combine 'steps' with top-level 'sql'/'expected' (set 'expected' on each step)", name)
+			}
+			tc.Steps = steps
+		}
+
+		// result / response の既定パスの基準（steps のテストはテスト名）
+		snapBase := tc.Expected
+		if snapBase == "" {
+			snapBase = safeName(name) + ".expected.sql"
+		}
 
-		if tc.SQLPath == "" || tc.Expected == "" {
-			return nil, fmt.Errorf("test '%s' missing sql/expected", name)
+		if p, ok := v["plan"]; ok && p != nil {
+			var ps PlanSpec
+			if err := remarshal(p, &ps); err != nil {
+				return nil, fmt.Errorf("test '%s' has invalid 'plan': %w", name, err)
+			}
+			if ps.defaultSnapshot {
+				ps.Snapshot = strings.TrimSuffix(snapshotPathFor(snapBase, "plan"), ".json") + ".txt"
+			}
+			if ps.Snapshot != "" {
+				ps.Snapshot = rel(cfgDir, ps.Snapshot)
+			}
+			if !ps.disabled {
+				tc.Plan = &ps
+			}
+		}
+		if p, ok := v["result"]; ok && p != nil {
+			var rs ResultSpec
+			if err := remarshal(p, &rs); err != nil {
+				return nil, fmt.Errorf("test '%s' has invalid 'result': %w", name, err)
+			}
+			if rs.Timezone != "" {
+				loc, err := time.LoadLocation(rs.Timezone)
+				if err != nil {
+					return nil, fmt.Errorf("test '%s' has invalid 'result.timezone': %w", name, err)
+				}
+				rs.loc = loc
+			}
+			if !rs.disabled {
+				if rs.Snapshot == "" {
+					rs.Snapshot = snapshotPathFor(snapBase, "result")
+				}
+				rs.Snapshot = rel(cfgDir, rs.Snapshot)
+				tc.Result = &rs
+			}
+		}
+		if p, ok := v["response"]; ok && p != nil {
+			var rs ResponseSpec
+			if err := remarshal(p, &rs); err != nil {
+				return nil, fmt.Errorf("test '%s' has invalid 'response': %w", name, err)
+			}
+			if !rs.disabled {
+				if rs.Snapshot == "" {
+					rs.Snapshot = snapshotPathFor(snapBase, "response")
+				}
+				rs.Snapshot = rel(cfgDir, rs.Snapshot)
+				tc.Response = &rs
+			}
+		}
+		if p, ok := v["expectColumns"]; ok && p != nil {
+			if err := remarshal(p, &tc.Columns); err != nil {
+				return nil, fmt.Errorf("test '%s' has invalid 'expectColumns': %w", name, err)
+			}
 		}
-		if tc.ParamsPath == "" && tc.ParamsInline == nil {
-			return nil, fmt.Errorf("test '%s' missing params (set a file path or an inline object)", name)
+
+		// todo のテストは未完成でもよい（sql/expected/params の省略を許す）
+		if len(tc.Steps) == 0 && !tc.Todo {
+			if tc.SQLPath == "" || tc.Expected == "" {
+				return nil, fmt.Errorf("test '%s' missing sql/expected", name)
+			}
+			if tc.ParamsPath == "" && tc.ParamsInline == nil {
+				return nil, fmt.Errorf("test '%s' missing params (set a file path or an inline object)", name)
+			}
 		}
 
-		tc.SQLPath = rel(cfgDir, tc.SQLPath)
-		tc.Expected = rel(cfgDir, tc.Expected)
+		if tc.SQLPath != "" {
+			tc.SQLPath = rel(cfgDir, tc.SQLPath)
+		}
+		if tc.Expected != "" {
+			tc.Expected = rel(cfgDir, tc.Expected)
+		}
 		if tc.Seed != "" {
 			tc.Seed = rel(cfgDir, tc.Seed)
 		}
@@ -1177,6 +4295,228 @@ func loadTests(path, cfgDir string) ([]TestCase, error) {
 	return out, nil
 }
 
+/* ============== Suite hooks ============== */
+
+// test.json のトップレベルの予約キー（テスト名には使えない）
+var hookKeys = []string{"beforeAll", "afterAll", "beforeEach", "afterEach"}
+
+func isHookKey(k string) bool {
+	for _, h := range hookKeys {
+		if k == h {
+			return true
+		}
+	}
+	return false
+}
+
+// フックの SQL。inTx=true ならトランザクション内で実行する
+// （*Each はテスト用トランザクション、*All は専用のトランザクション）
+type hookSQL struct {
+	path      string
+	sql       string
+	inTx      bool
+	reconnect bool // beforeAll のみ: 共有の接続を張り替えたときにも流し直す
+}
+
+type suiteHooks struct {
+	BeforeAll, AfterAll, BeforeEach, AfterEach []hookSQL
+}
+
+// main で test.json から読み込む（runOne が参照する）
+var testHooks suiteHooks
+
+// フックの失敗（テストの F/E とは別に 'H' として集計する）
+type hookError struct {
+	kind string // beforeAll / afterAll / beforeEach / afterEach
+	path string
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s hook %s: %v", e.kind, filepath.Base(e.path), e.err)
+}
+func (e *hookError) Unwrap() error { return e.err }
+
+// test.json の beforeAll/afterAll/beforeEach/afterEach を読む。
+// 各要素は "path.sql" か {"sql": "path.sql", "inTx": bool}（beforeAll は "reconnect": bool も可）。
+// inTx の既定は *Each が true（テスト用トランザクション内）、*All が false（autocommit）
+func loadHooks(path, cfgDir string) (suiteHooks, error) {
+	var h suiteHooks
+	b, err := readTestJSON(path)
+	if err != nil {
+		return h, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return h, fmt.Errorf("invalid test.json: %w", err)
+	}
+	for _, kind := range hookKeys {
+		rm, ok := raw[kind]
+		if !ok {
+			continue
+		}
+		var items []any
+		if err := json.Unmarshal(rm, &items); err != nil {
+			return h, fmt.Errorf("'%s' must be an array of SQL files: %w", kind, err)
+		}
+		var list []hookSQL
+		for i, it := range items {
+			hs := hookSQL{inTx: strings.HasSuffix(kind, "Each")}
+			switch v := it.(type) {
+			case string:
+				hs.path = v
+			case map[string]any:
+				hs.path = pickString(v, "sql")
+				if t, ok := v["inTx"].(bool); ok {
+					hs.inTx = t
+				}
+				if r, ok := v["reconnect"].(bool); ok {
+					if kind != "beforeAll" {
+						return h, fmt.Errorf("'%s'[%d]: 'reconnect' is only for beforeAll", kind, i)
+					}
+					hs.reconnect = r
+				}
+			}
+			if strings.TrimSpace(hs.path) == "" {
+				return h, fmt.Errorf("'%s'[%d]: sql file path expected", kind, i)
+			}
+			hs.path = rel(cfgDir, hs.path)
+			sb, err := os.ReadFile(hs.path)
+			if err != nil {
+				return h, fmt.Errorf("'%s'[%d]: %w", kind, i, err)
+			}
+			hs.sql = string(sb)
+			list = append(list, hs)
+		}
+		switch kind {
+		case "beforeAll":
+			h.BeforeAll = list
+		case "afterAll":
+			h.AfterAll = list
+		case "beforeEach":
+			h.BeforeEach = list
+		case "afterEach":
+			h.AfterEach = list
+		}
+	}
+	return h, nil
+}
+
+// inTx が一致するフックを順に実行する。最初の失敗で止める
+func runHooks(ctx context.Context, ex execer, dialect, kind string, hooks []hookSQL, inTx bool) error {
+	for _, hs := range hooks {
+		if hs.inTx != inTx {
+			continue
+		}
+		if err := execBatch(ctx, ex, dialect, hs.sql); err != nil {
+			return &hookError{kind: kind, path: hs.path, err: err}
+		}
+	}
+	return nil
+}
+
+// beforeAll / afterAll を実行する（テストと同じ共有の接続）。
+// inTx=false は autocommit、inTx=true はまとめて 1 トランザクションで COMMIT する
+func runSuiteHooks(kind string, hooks []hookSQL, driverName, dsn string, conf *NyanConfig, timeout time.Duration) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	db, closeDB, err := sessionFor(driverName, dsn, conf)
+	if err != nil {
+		return &hookError{kind: kind, path: hooks[0].path, err: err}
+	}
+	defer closeDB()
+
+	for _, hs := range hooks {
+		if !hs.inTx {
+			if err := runHooks(ctx, db, dialectName(driverName), kind, []hookSQL{hs}, false); err != nil {
+				return err
+			}
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return &hookError{kind: kind, path: hs.path, err: err}
+		}
+		if err := runHooks(ctx, tx, dialectName(driverName), kind, []hookSQL{hs}, true); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return &hookError{kind: kind, path: hs.path, err: err}
+		}
+	}
+	return nil
+}
+
+// "steps" を読み込む。params を省略した step はテストの params を使う
+func loadSteps(p any, cfgDir string, tc TestCase) ([]TestStep, error) {
+	list, ok := p.([]any)
+	if !ok {
+		return nil, errors.New("array expected")
+	}
+	var out []TestStep
+	for i, x := range list {
+		m, ok := x.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("step %d: object expected", i+1)
+		}
+		st := TestStep{Name: pickString(m, "name")}
+		st.SQLPath = pickString(m, "sql")
+		if st.SQLPath == "" {
+			st.SQLPath = pickString(m, "SQL")
+		}
+		if st.SQLPath == "" {
+			return nil, fmt.Errorf("step %d: missing sql", i+1)
+		}
+		st.SQLPath = rel(cfgDir, st.SQLPath)
+		if e := pickString(m, "expected"); e != "" {
+			st.Expected = rel(cfgDir, e)
+		}
+		if c, ok := m["capture"]; ok && c != nil {
+			if err := remarshal(c, &st.Capture); err != nil {
+				return nil, fmt.Errorf("step %d: invalid 'capture' (object of key -> path expected): %w", i+1, err)
+			}
+			// $.rows は最後の文を Query で実行するため sql.Result（lastInsertId / rowsAffected）が得られない
+			if captureNeedsRows(st.Capture) {
+				for _, key := range slices.Sorted(maps.Keys(st.Capture)) {
+					path := st.Capture[key]
+					if m := reCapturePath.FindStringSubmatch(strings.TrimSpace(path)); m != nil && m[3] != "" {
+						return nil, fmt.Errorf("step %d: capture %q: %s cannot be combined with $.rows in the same step (the last statement is run as a query, which has no %s; use RETURNING and $.rows instead)", i+1, key, path, m[3])
+					}
+				}
+			}
+		}
+		switch pv := m["params"].(type) {
+		case string:
+			st.ParamsPath = rel(cfgDir, strings.TrimPrefix(strings.TrimSpace(pv), "config:"))
+		case map[string]any:
+			st.ParamsInline = pv
+		case nil:
+			st.ParamsPath, st.ParamsInline = tc.ParamsPath, tc.ParamsInline
+		default:
+			return nil, fmt.Errorf("step %d: invalid 'params' (string path or object expected)", i+1)
+		}
+		if st.ParamsPath == "" && st.ParamsInline == nil {
+			return nil, fmt.Errorf("step %d: missing params (set them on the step or the test)", i+1)
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// map[string]any などを JSON 経由で構造体へ詰め替える
+func remarshal(src, dst any) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
 func pickString(m map[string]any, key string) string {
 	if v, ok := m[key]; ok {
 		if s, ok := v.(string); ok {
@@ -1186,6 +4526,15 @@ func pickString(m map[string]any, key string) string {
 	return ""
 }
 
+func pickInt(m map[string]any, key string) int {
+	if v, ok := m[key]; ok {
+		if f, ok := v.(float64); ok {
+			return int(f)
+		}
+	}
+	return 0
+}
+
 func rel(base, p string) string {
 	if filepath.IsAbs(p) || p == "" {
 		return p
@@ -1230,7 +4579,12 @@ func extractParamDefaults(sqlText string) map[string]any {
 			if i, err := strconv.ParseInt(defWhole, 10, 64); err == nil {
 				m[name] = i
 			} else if f, err := strconv.ParseFloat(defWhole, 64); err == nil {
-				m[name] = f
+				if sameDecimal(strconv.FormatFloat(f, 'f', -1, 64), defWhole) {
+					m[name] = f
+				} else {
+					// float64 では桁が落ちるので $decimal で書かれたまま渡す（"+0.1" などは JSON の数値にできない）
+					m[name] = map[string]any{"$decimal": defWhole}
+				}
 			} else {
 				m[name] = defWhole
 			}
@@ -1276,15 +4630,36 @@ type TestDef struct {
 	Tags        []string       `json:"tags,omitempty"`
 	SQL         string         `json:"sql,omitempty"`
 	Params      any            `json:"params,omitempty"`    // string path or object
-	Expected    string         `json:"expected"`
+	Expected    string         `json:"expected,omitempty"`
 	Normalize   map[string]any `json:"normalize,omitempty"` // e.g. {"sqlFmt": true}
 	Description string         `json:"description,omitempty"`
 	Seed        string         `json:"seed,omitempty"`
+	Plan        *PlanSpec      `json:"plan,omitempty"`
+	MaxDuration int            `json:"maxDurationMs,omitempty"`
+	Timeout     int            `json:"timeoutSec,omitempty"`
+	SeedTimeout int            `json:"seedTimeoutSec,omitempty"`
+	Result      *ResultSpec    `json:"result,omitempty"`
+	Columns     []ColumnSpec   `json:"expectColumns,omitempty"`
+	Response    *ResponseSpec  `json:"response,omitempty"`
+	Steps       []StepDef      `json:"steps,omitempty"`
+	Skip        any            `json:"skip,omitempty"` // true or reason string
+	Todo        bool           `json:"todo,omitempty"`
+	Drivers     []string       `json:"drivers,omitempty"`
+	SkipDrivers []string       `json:"skipDrivers,omitempty"`
+}
+
+// TestDef の "steps" の1要素
+type StepDef struct {
+	Name     string            `json:"name,omitempty"`
+	SQL      string            `json:"sql"`
+	Params   any               `json:"params,omitempty"` // string path or object（省略時はテストの params）
+	Expected string            `json:"expected,omitempty"`
+	Capture  map[string]string `json:"capture,omitempty"`
 }
 
 func genSQLCmd(args []string) {
 	fs := flag.NewFlagSet("gen-sql", flag.ExitOnError)
-	var srcDir, outDir, expDir, combineOut string
+	var srcDir, outDir, expDir, combineOut, dialectOpt string
 	var overwrite, autoExp bool
 	fs.StringVar(&srcDir, "src", "./sql", "directory containing SQL files")
 	fs.StringVar(&outDir, "out", "./tests-sql", "directory to write *.test.jsonc")
@@ -1292,8 +4667,14 @@ func genSQLCmd(args []string) {
 	fs.StringVar(&combineOut, "combine", "", "write combined test.json here (optional)")
 	fs.BoolVar(&overwrite, "overwrite", false, "overwrite existing test files")
 	fs.BoolVar(&autoExp, "auto-expected", false, "render and write expected for each test if missing (or when -overwrite)")
+	fs.StringVar(&dialectOpt, "dialect", "", "write expected as *.expected.<dialect>.sql (sqlite|mysql|postgres|duckdb)")
 	_ = fs.Parse(args)
 
+	dialect := ""
+	if d := strings.ToLower(strings.TrimSpace(dialectOpt)); d != "" {
+		dialect = dialectName(mapDriver(d))
+	}
+
 	die(os.MkdirAll(outDir, 0o755))
 	die(os.MkdirAll(expDir, 0o755))
 	paramsDir := filepath.Join(outDir, "_params")
@@ -1331,22 +4712,7 @@ func genSQLCmd(args []string) {
 		expPath := filepath.Join(expDir, sqlBase+".expected.sql")
 
 		if overwrite || fileNotExists(outPath) {
-			params := guessParamsFromSQL(sqlContent)
-			if _, err := os.Stat(paramPath); os.IsNotExist(err) || overwrite {
-				die(writeParamsJSONC(paramPath, params, "Auto-generated from SQL placeholders"))
-			}
-			if autoExp {
-				pb, _ := os.ReadFile(paramPath)
-				pm, _ := decodeParams(pb)
-				rendered, err := renderNyanSQL(sqlContent, pm)
-				die(err)
-				die(os.MkdirAll(filepath.Dir(expPath), 0o755))
-				die(os.WriteFile(expPath, []byte(addNewline(rendered)), 0o644))
-			} else {
-				if fileNotExists(expPath) {
-					_ = os.WriteFile(expPath, []byte("-- filled by snapshot update\n"), 0o644)
-				}
-			}
+			genBaseTest(sqlContent, paramPath, expPath, dialect, overwrite, autoExp)
 			td := TestDef{
 				Name:        sqlBase,
 				SQL:         relFrom(outDir, sqlPath),
@@ -1370,49 +4736,226 @@ func genSQLCmd(args []string) {
 			paramPath2 := filepath.Join(paramsDir, name2+".params.jsonc")
 			expPath2 := filepath.Join(expDir, name2+".expected.sql")
 
-			if !overwrite {
-				if _, err := os.Stat(outPath2); err == nil {
-					fmt.Println("skip (exists):", outPath2)
-					continue
-				}
-			}
+			if !overwrite {
+				if _, err := os.Stat(outPath2); err == nil {
+					fmt.Println("skip (exists):", outPath2)
+					continue
+				}
+			}
+
+			// ベース params を読み、該当キーにダミー値を設定
+			baseParams := guessParamsFromSQL(sqlContent)
+			for k := range baseParams {
+				// 既にデフォルトがあるものはそのまま、無いものは空
+				if baseParams[k] == nil {
+					baseParams[k] = ""
+				}
+			}
+			baseParams[key] = sampleValueForKey(key)
+
+			die(writeParamsJSONC(paramPath2, baseParams, "Auto-generated variant (truthy) for "+key))
+
+			pm, _ := decodeParams([]byte(toJSONString(baseParams)))
+			writeGenExpected(sqlContent, pm, expPath2, dialect, autoExp)
+
+			td2 := TestDef{
+				Name:        name2,
+				SQL:         relFrom(outDir, sqlPath),
+				Params:      relFrom(outDir, paramPath2),
+				Expected:    relFrom(outDir, expPath2),
+				Normalize:   map[string]any{"sqlFmt": true},
+				Tags:        []string{"auto", "sql", "variant"},
+				Description: "Auto-generated truthy variant by NyanTEST gen-sql",
+			}
+			die(writeJSONC(outPath2, td2))
+			fmt.Println("generated:", outPath2)
+		}
+	}
+
+	if strings.TrimSpace(combineOut) != "" {
+		die(combineTests(outDir, combineOut))
+		fmt.Println("combined:", combineOut)
+	}
+
+	fmt.Printf("Done. You can now run:\n  NyanTEST -config %s\n", firstNonEmpty(combineOut, outDir))
+}
+
+// params（未作成時 or -overwrite）と expected を1テスト分生成する（gen-sql / gen-api 共通）
+func genBaseTest(sqlContent, paramPath, expPath, dialect string, overwrite, autoExp bool) {
+	params := guessParamsFromSQL(sqlContent)
+	if _, err := os.Stat(paramPath); os.IsNotExist(err) || overwrite {
+		die(writeParamsJSONC(paramPath, params, "Auto-generated from SQL placeholders"))
+	}
+	pb, _ := os.ReadFile(paramPath)
+	pm, _ := decodeParams(pb)
+	writeGenExpected(sqlContent, pm, expPath, dialect, autoExp)
+}
+
+// gen-sql / gen-api の expected を書く（autoExp なら常に、そうでなければ無い場合のみ）。
+// -dialect 指定時は常にレンダリング結果を書き、共通の expected（無ければ方言なしの
+// レンダリング結果）と異なる場合だけ name.expected.<dialect>.sql にする
+func writeGenExpected(sqlContent string, params map[string]any, expPath, dialect string, autoExp bool) {
+	if dialect == "" {
+		if autoExp {
+			rendered, err := renderNyanSQLWith(sqlContent, params, "", nil)
+			die(err)
+			die(os.MkdirAll(filepath.Dir(expPath), 0o755))
+			die(os.WriteFile(expPath, []byte(addNewline(rendered)), 0o644))
+		} else if fileNotExists(expPath) {
+			_ = os.WriteFile(expPath, []byte("-- filled by snapshot update\n"), 0o644)
+		}
+		return
+	}
+
+	rendered, err := renderNyanSQLWith(sqlContent, params, dialect, nil)
+	die(err)
+	common, err := os.ReadFile(expPath)
+	if err != nil {
+		generic, gerr := renderNyanSQLWith(sqlContent, params, "", nil)
+		die(gerr)
+		common = []byte(generic)
+	}
+	target := expPath
+	if !equalSQL(string(common), rendered) {
+		target = dialectExpectedPath(expPath, dialect)
+	}
+	if autoExp || fileNotExists(target) {
+		die(os.MkdirAll(filepath.Dir(target), 0o755))
+		die(os.WriteFile(target, []byte(addNewline(rendered)), 0o644))
+	}
+}
+
+/* ============== Generator: gen-api ============== */
+
+// NyanQL の api.json の1エンドポイント
+type apiEndpoint struct {
+	SQL         []string
+	Script      string
+	Description string
+}
+
+// api.json（JSONC 可）を読み込む。"sql" は文字列または配列
+func loadAPIDefs(path string) (map[string]apiEndpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]any
+	if err := json.Unmarshal([]byte(stripTrailingCommas(stripJSONC(string(b)))), &raw); err != nil {
+		return nil, fmt.Errorf("invalid api.json: %w", err)
+	}
+	out := map[string]apiEndpoint{}
+	for name, v := range raw {
+		ep := apiEndpoint{
+			Script:      pickString(v, "script"),
+			Description: pickString(v, "description"),
+		}
+		switch sv := v["sql"].(type) {
+		case string:
+			ep.SQL = []string{sv}
+		case []any:
+			for _, x := range sv {
+				if s, ok := x.(string); ok {
+					ep.SQL = append(ep.SQL, s)
+				}
+			}
+		case nil:
+		default:
+			return nil, fmt.Errorf("api '%s' has invalid 'sql' (string or array expected)", name)
+		}
+		out[name] = ep
+	}
+	return out, nil
+}
+
+func genAPICmd(args []string) {
+	fs := flag.NewFlagSet("gen-api", flag.ExitOnError)
+	var apiPath, baseDir, outDir, expDir, combineOut, dialectOpt string
+	var overwrite, autoExp bool
+	fs.StringVar(&apiPath, "api", "./api.json", "NyanQL API definition file (api.json)")
+	fs.StringVar(&baseDir, "base", "", "directory the SQL paths in api.json are relative to (default: directory of -api)")
+	fs.StringVar(&outDir, "out", "./tests-api", "directory to write *.test.jsonc")
+	fs.StringVar(&expDir, "expected", "./expected-api", "directory to write expected rendered SQL")
+	fs.StringVar(&combineOut, "combine", "", "write combined test.json here (optional)")
+	fs.BoolVar(&overwrite, "overwrite", false, "overwrite existing test files")
+	fs.BoolVar(&autoExp, "auto-expected", false, "render and write expected for each test if missing (or when -overwrite)")
+	fs.StringVar(&dialectOpt, "dialect", "", "write expected as *.expected.<dialect>.sql (sqlite|mysql|postgres|duckdb)")
+	_ = fs.Parse(args)
+
+	dialect := ""
+	if d := strings.ToLower(strings.TrimSpace(dialectOpt)); d != "" {
+		dialect = dialectName(mapDriver(d))
+	}
+	if baseDir == "" {
+		baseDir = filepath.Dir(apiPath)
+	}
+
+	apis, err := loadAPIDefs(apiPath)
+	die(err)
 
-			// ベース params を読み、該当キーにダミー値を設定
-			baseParams := guessParamsFromSQL(sqlContent)
-			for k := range baseParams {
-				// 既にデフォルトがあるものはそのまま、無いものは空
-				if baseParams[k] == nil {
-					baseParams[k] = ""
-				}
-			}
-			baseParams[key] = sampleValueForKey(key)
+	die(os.MkdirAll(outDir, 0o755))
+	die(os.MkdirAll(expDir, 0o755))
+	paramsDir := filepath.Join(outDir, "_params")
+	die(os.MkdirAll(paramsDir, 0o755))
 
-			die(writeParamsJSONC(paramPath2, baseParams, "Auto-generated variant (truthy) for "+key))
+	names := make([]string, 0, len(apis))
+	for k := range apis {
+		names = append(names, k)
+	}
+	sort.Strings(names)
 
-			if autoExp {
-				pm, _ := decodeParams([]byte(toJSONString(baseParams)))
-				rendered, err := renderNyanSQL(sqlContent, pm)
-				die(err)
-				die(os.MkdirAll(filepath.Dir(expPath2), 0o755))
-				die(os.WriteFile(expPath2, []byte(addNewline(rendered)), 0o644))
-			} else {
-				if fileNotExists(expPath2) {
-					_ = os.WriteFile(expPath2, []byte("-- filled by snapshot update\n"), 0o644)
-				}
-			}
+	for _, apiName := range names {
+		ep := apis[apiName]
+		if len(ep.SQL) == 0 {
+			fmt.Println("skip (no sql):", apiName)
+			continue
+		}
+		desc := ep.Description
+		if desc == "" {
+			desc = "Auto-generated from api.json by NyanTEST gen-api"
+		}
 
-			td2 := TestDef{
-				Name:        name2,
-				SQL:         relFrom(outDir, sqlPath),
-				Params:      relFrom(outDir, paramPath2),
-				Expected:    relFrom(outDir, expPath2),
-				Normalize:   map[string]any{"sqlFmt": true},
-				Tags:        []string{"auto", "sql", "variant"},
-				Description: "Auto-generated truthy variant by NyanTEST gen-sql",
+		// 1エンドポイント = 1テスト。SQL が複数ある場合は定義順の steps にする
+		fileBase := safeName(apiName)
+		outPath := filepath.Join(outDir, fileBase+".test.jsonc")
+		if !overwrite && !fileNotExists(outPath) {
+			fmt.Println("skip (exists):", outPath)
+			continue
+		}
+		td := TestDef{
+			Name:        apiName,
+			Normalize:   map[string]any{"sqlFmt": true},
+			Tags:        []string{"auto", "api", "endpoint:" + apiName},
+			Description: desc,
+		}
+		for i, sp := range ep.SQL {
+			sqlPath := absFrom(baseDir, sp)
+			sqlContentB, err := os.ReadFile(sqlPath)
+			die(err)
+
+			stepBase := fileBase
+			if len(ep.SQL) > 1 {
+				stepBase = fmt.Sprintf("%s__step%d", fileBase, i+1)
 			}
-			die(writeJSONC(outPath2, td2))
-			fmt.Println("generated:", outPath2)
+			paramPath := filepath.Join(paramsDir, stepBase+".params.jsonc")
+			expPath := filepath.Join(expDir, stepBase+".expected.sql")
+			genBaseTest(string(sqlContentB), paramPath, expPath, dialect, overwrite, autoExp)
+
+			if len(ep.SQL) == 1 {
+				td.SQL = relFrom(outDir, sqlPath)
+				td.Params = relFrom(outDir, paramPath)
+				td.Expected = relFrom(outDir, expPath)
+				break
+			}
+			td.Steps = append(td.Steps, StepDef{
+				Name:     strings.TrimSuffix(filepath.Base(sqlPath), filepath.Ext(sqlPath)),
+				SQL:      relFrom(outDir, sqlPath),
+				Params:   relFrom(outDir, paramPath),
+				Expected: relFrom(outDir, expPath),
+			})
 		}
+		die(writeJSONC(outPath, td))
+		fmt.Println("generated:", outPath)
 	}
 
 	if strings.TrimSpace(combineOut) != "" {
@@ -1467,6 +5010,21 @@ func combineTests(inDir, outFile string) error {
 
 	combined := map[string]any{}
 	nameUsed := map[string]struct{}{}
+	for _, k := range hookKeys {
+		nameUsed[k] = struct{}{}
+	}
+
+	// 既存の test.json にあるフック（beforeAll など）は引き継ぐ（パスの基準は同じ）
+	if b, err := os.ReadFile(outFile); err == nil {
+		var prev map[string]json.RawMessage
+		if json.Unmarshal(b, &prev) == nil {
+			for _, k := range hookKeys {
+				if v, ok := prev[k]; ok {
+					combined[k] = v
+				}
+			}
+		}
+	}
 
 	outDir := filepath.Dir(outFile)
 	paramsDir := filepath.Join(outDir, "_params") // 必要時に writeParamsJSONC が作成
@@ -1493,10 +5051,32 @@ func combineTests(inDir, outFile string) error {
 		}
 		nameUsed[key] = struct{}{}
 
-		td.Expected = relFrom(outDir, absFrom(filepath.Dir(f), td.Expected))
+		if td.Expected != "" {
+			td.Expected = relFrom(outDir, absFrom(filepath.Dir(f), td.Expected))
+		}
+		for i, st := range td.Steps {
+			st.SQL = relFrom(outDir, absFrom(filepath.Dir(f), st.SQL))
+			if st.Expected != "" {
+				st.Expected = relFrom(outDir, absFrom(filepath.Dir(f), st.Expected))
+			}
+			if ps, ok := st.Params.(string); ok {
+				ps = strings.TrimPrefix(strings.TrimSpace(ps), "config:")
+				st.Params = relFrom(outDir, absFrom(filepath.Dir(f), ps))
+			}
+			td.Steps[i] = st
+		}
 		if td.SQL != "" {
 			td.SQL = relFrom(outDir, absFrom(filepath.Dir(f), td.SQL))
 		}
+		if td.Plan != nil && td.Plan.Snapshot != "" {
+			td.Plan.Snapshot = relFrom(outDir, absFrom(filepath.Dir(f), td.Plan.Snapshot))
+		}
+		if td.Result != nil && td.Result.Snapshot != "" {
+			td.Result.Snapshot = relFrom(outDir, absFrom(filepath.Dir(f), td.Result.Snapshot))
+		}
+		if td.Response != nil && td.Response.Snapshot != "" {
+			td.Response.Snapshot = relFrom(outDir, absFrom(filepath.Dir(f), td.Response.Snapshot))
+		}
 
 		switch pv := td.Params.(type) {
 		case string:
@@ -1528,6 +5108,555 @@ func combineTests(inDir, outFile string) error {
 	return os.WriteFile(outFile, b, 0o644)
 }
 
+/* ============== Linter: lint ============== */
+
+type lintFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"` // error / warning
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+// lint のルール（SARIF の rules にもそのまま出す）
+var lintRules = []struct{ id, desc string }{
+	{"unbalanced-block", "IF / BEGIN / END and /*? key ?*/ ... /*?*/ blocks must be balanced"},
+	{"nested-block", "IF or BEGIN inside IF, and BEGIN inside BEGIN, are not supported by the renderer (the inner END closes the outer block)"},
+	{"placeholder-no-default", "a placeholder without a default literal is left in the rendered SQL"},
+	{"bad-if-condition", "IF condition that the renderer cannot evaluate"},
+	{"default-quote-mismatch", "string default literal with mismatched quotes"},
+	{"key-type-conflict", "the same key is used both as a bool and as a value"},
+	{"double-quoted-default", "a \"...\" default is rendered as an identifier (backticks on mysql), not as a string"},
+}
+
+var (
+	reComment    = regexp.MustCompile(`/\*([\s\S]*?)\*/`)
+	reLintIf     = regexp.MustCompile(`(?is)^IF\s+(.+)$`)
+	reLintEnd    = regexp.MustCompile(`(?i)^(?:END|ENDIF|FI)$`)
+	reLintOpt    = regexp.MustCompile(`^\?\s*([A-Za-z0-9_]+)\s*\?$`)
+	reLintOptEnd = regexp.MustCompile(`^\?\s*$`)
+	reIdent      = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+func lintCmd(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var srcDir, format, outPath string
+	fs.StringVar(&srcDir, "src", "./sql", "SQL template file or directory to lint (*.sql, recursive)")
+	fs.StringVar(&format, "format", "text", "output format: text|json|sarif")
+	fs.StringVar(&outPath, "out", "", "write the report to this path (default: stdout)")
+	_ = fs.Parse(args)
+
+	var files []string
+	die(filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(strings.ToLower(p), ".sql") {
+			files = append(files, p)
+		}
+		return nil
+	}))
+	sort.Strings(files)
+
+	var findings []lintFinding
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		die(err)
+		findings = append(findings, lintTemplate(filepath.ToSlash(f), string(b))...)
+	}
+	errs := 0
+	for _, f := range findings {
+		if f.Severity == "error" {
+			errs++
+		}
+	}
+
+	var out []byte
+	switch strings.ToLower(format) {
+	case "text":
+		var b strings.Builder
+		for _, f := range findings {
+			fmt.Fprintf(&b, "%s:%d:%d: %s: [%s] %s\n", f.File, f.Line, f.Column, f.Severity, f.Rule, f.Message)
+		}
+		fmt.Fprintf(&b, "%d file(s), %d error(s), %d warning(s)\n", len(files), errs, len(findings)-errs)
+		out = []byte(b.String())
+	case "json":
+		if findings == nil {
+			findings = []lintFinding{}
+		}
+		b, err := json.MarshalIndent(map[string]any{"files": len(files), "findings": findings}, "", "  ")
+		die(err)
+		out = append(b, '\n')
+	case "sarif":
+		b, err := json.MarshalIndent(lintSARIF(findings), "", "  ")
+		die(err)
+		out = append(b, '\n')
+	default:
+		die(fmt.Errorf("lint: unknown -format %q (text|json|sarif)", format))
+	}
+
+	if outPath == "" {
+		os.Stdout.Write(out)
+	} else {
+		die(os.MkdirAll(filepath.Dir(outPath), 0o755))
+		die(os.WriteFile(outPath, out, 0o644))
+		fmt.Printf("lint: %d error(s), %d warning(s) -> %s\n", errs, len(findings)-errs, outPath)
+	}
+	if errs > 0 {
+		os.Exit(1)
+	}
+}
+
+// 1ファイル分の静的チェック（DB 不要）
+func lintTemplate(file, tpl string) []lintFinding {
+	var out []lintFinding
+	pos := func(off int) (int, int) {
+		line := 1 + strings.Count(tpl[:off], "\n")
+		col := 1 + len([]rune(tpl[strings.LastIndex(tpl[:off], "\n")+1:off]))
+		return line, col
+	}
+	add := func(off int, sev, rule, format string, a ...any) {
+		ln, col := pos(off)
+		out = append(out, lintFinding{File: file, Line: ln, Column: col, Severity: sev, Rule: rule, Message: fmt.Sprintf(format, a...)})
+	}
+
+	// reParam が値を置換できるプレースホルダ（開始位置 → デフォルト値）
+	params := map[int]string{}
+	for _, m := range reParam.FindAllStringSubmatchIndex(tpl, -1) {
+		params[m[0]] = tpl[m[4]:m[5]]
+	}
+
+	// キーの使われ方（bool / value）と最初の位置
+	type use struct {
+		off  int
+		what string
+	}
+	boolUse := map[string]use{}
+	valueUse := map[string]use{}
+	note := func(key string, v any, off int, what string) {
+		switch v.(type) {
+		case nil:
+		case bool:
+			if _, ok := boolUse[key]; !ok {
+				boolUse[key] = use{off, what}
+			}
+		default:
+			if _, ok := valueUse[key]; !ok {
+				valueUse[key] = use{off, what}
+			}
+		}
+	}
+
+	type open struct {
+		kind string // IF / BEGIN / OPTIONAL
+		off  int
+	}
+	var stack []open
+	inside := func(kind string) bool {
+		for _, o := range stack {
+			if o.kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range reComment.FindAllStringSubmatchIndex(tpl, -1) {
+		// レンダラと同じく /*END*/ などは空白なしのみ（/* END */ はただのコメント）
+		off := m[0]
+		body := tpl[m[2]:m[3]]
+		switch {
+		case strings.EqualFold(body, "BEGIN"):
+			// IF は BEGIN より先に展開されるので、IF の中の BEGIN も内側の END で IF が閉じてしまう
+			if inside("IF") {
+				add(off, "error", "nested-block", "BEGIN inside IF is not supported (the inner END closes the outer IF)")
+			} else if inside("BEGIN") {
+				add(off, "error", "nested-block", "BEGIN inside BEGIN is not supported (the inner END closes the outer BEGIN)")
+			}
+			stack = append(stack, open{"BEGIN", off})
+		case reLintIf.MatchString(body):
+			cond := strings.TrimSpace(reLintIf.FindStringSubmatch(body)[1])
+			if inside("IF") {
+				add(off, "error", "nested-block", "IF inside IF is not supported (the inner END closes the outer IF)")
+			}
+			stack = append(stack, open{"IF", off})
+			lhs, op, rhs, err := parseCond(cond)
+			switch {
+			case strings.Contains(cond, "*"):
+				add(off, "error", "bad-if-condition", "IF condition %q must not contain '*'", cond)
+			case err != nil:
+				add(off, "error", "bad-if-condition", "%v", err)
+			case !reIdent.MatchString(lhs):
+				add(off, "error", "bad-if-condition", "IF condition %q: left-hand side must be a params key", cond)
+			case op != "":
+				note(lhs, rhs, off, "compared in IF")
+			default:
+				note(lhs, true, off, "used as bool")
+			}
+		case reLintEnd.MatchString(body):
+			if len(stack) == 0 || stack[len(stack)-1].kind == "OPTIONAL" {
+				add(off, "error", "unbalanced-block", "/*%s*/ without a matching IF or BEGIN", body)
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case reLintOpt.MatchString(body):
+			if inside("OPTIONAL") {
+				add(off, "error", "nested-block", "/*? ?*/ inside /*? ?*/ is not supported")
+			}
+			stack = append(stack, open{"OPTIONAL", off})
+			note(reLintOpt.FindStringSubmatch(body)[1], true, off, "used as bool")
+		case reLintOptEnd.MatchString(body):
+			if len(stack) == 0 || stack[len(stack)-1].kind != "OPTIONAL" {
+				add(off, "error", "unbalanced-block", "/*?*/ without a matching /*? key ?*/")
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case reIdent.MatchString(body):
+			lintPlaceholder(tpl, off, m[1], body, params[off], add)
+			if def, ok := params[off]; ok {
+				if v, ok := literalValue(def); ok {
+					note(body, v, off, "placeholder default")
+				}
+			}
+		}
+	}
+	for _, o := range stack {
+		name := o.kind
+		if name == "OPTIONAL" {
+			name = "/*? ?*/"
+		}
+		add(o.off, "error", "unbalanced-block", "%s is never closed", name)
+	}
+
+	keys := make([]string, 0, len(boolUse))
+	for k := range boolUse {
+		if _, ok := valueUse[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, v := boolUse[k], valueUse[k]
+		later := max(b.off, v.off)
+		bl, _ := pos(b.off)
+		vl, _ := pos(v.off)
+		add(later, "warning", "key-type-conflict", "key %q is used as a bool (%s, line %d) and as a value (%s, line %d)", k, b.what, bl, v.what, vl)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Line != out[j].Line {
+			return out[i].Line < out[j].Line
+		}
+		return out[i].Column < out[j].Column
+	})
+	return out
+}
+
+// /*key*/ の直後のデフォルト値を検査する（def は reParam がマッチしたデフォルト値。無ければ空）
+func lintPlaceholder(tpl string, off, end int, key, def string, add func(off int, sev, rule, format string, a ...any)) {
+	rest := tpl[end:]
+	tok := rest
+	if i := strings.IndexAny(tok, " \t\r\n,)"); i >= 0 {
+		tok = tok[:i]
+	}
+	if len(tok) >= 2 && (tok[0] == '\'' && tok[len(tok)-1] == '"' || tok[0] == '"' && tok[len(tok)-1] == '\'') {
+		add(off, "error", "default-quote-mismatch", "default of /*%s*/ starts with %c but ends with %c: %s", key, tok[0], tok[len(tok)-1], tok)
+		return
+	}
+	if def != "" {
+		if (def[0] == '\'' || def[0] == '"') && strings.Contains(def, "\n") {
+			add(off, "error", "default-quote-mismatch", "string default of /*%s*/ spans lines (unbalanced quote?)", key)
+			return
+		}
+		if def[0] == '"' {
+			add(off, "warning", "double-quoted-default", "default of /*%s*/ is %s: the value is rendered as an identifier (`...` on mysql); use '...' for a string value", key, def)
+		}
+		return
+	}
+	if strings.HasPrefix(rest, "'") || strings.HasPrefix(rest, `"`) {
+		add(off, "error", "default-quote-mismatch", "string default of /*%s*/ is never closed", key)
+		return
+	}
+	add(off, "error", "placeholder-no-default", "/*%s*/ has no default literal ('...', \"...\", number, true, false or null) and is left in the rendered SQL", key)
+}
+
+// デフォルト値のリテラルを値にする（型の判定用）
+func literalValue(lit string) (any, bool) {
+	switch {
+	case strings.EqualFold(lit, "null"):
+		return nil, true
+	case strings.EqualFold(lit, "true"):
+		return true, true
+	case strings.EqualFold(lit, "false"):
+		return false, true
+	case strings.HasPrefix(lit, "'") || strings.HasPrefix(lit, `"`):
+		return lit[1 : len(lit)-1], true
+	}
+	if f, err := strconv.ParseFloat(lit, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// SARIF 2.1.0（GitHub code scanning などに読み込ませる）
+func lintSARIF(findings []lintFinding) map[string]any {
+	rules := make([]map[string]any, 0, len(lintRules))
+	for _, r := range lintRules {
+		rules = append(rules, map[string]any{
+			"id":               r.id,
+			"shortDescription": map[string]any{"text": r.desc},
+		})
+	}
+	results := make([]map[string]any, 0, len(findings))
+	for _, f := range findings {
+		results = append(results, map[string]any{
+			"ruleId":  f.Rule,
+			"level":   f.Severity,
+			"message": map[string]any{"text": f.Message},
+			"locations": []any{map[string]any{
+				"physicalLocation": map[string]any{
+					"artifactLocation": map[string]any{"uri": f.File},
+					"region":           map[string]any{"startLine": f.Line, "startColumn": f.Column},
+				},
+			}},
+		})
+	}
+	return map[string]any{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []any{map[string]any{
+			"tool": map[string]any{"driver": map[string]any{
+				"name":    "NyanTEST",
+				"version": Version,
+				"rules":   rules,
+			}},
+			"results": results,
+		}},
+	}
+}
+
+/* ============== Fuzz: fuzz ============== */
+
+// 1キーに入れる値の候補（fuzzAbsent はキー自体を入れない）
+var fuzzAbsent = new(struct{})
+
+var fuzzValues = []any{
+	fuzzAbsent, nil, "", "a", json.Number("0"), json.Number("1"), json.Number("-1"), json.Number("1.5"), true, false,
+	map[string]any{"$date": "2025-01-01"},
+	map[string]any{"$timestamp": "2025-01-01 10:00:00"},
+	map[string]any{"$decimal": "12345678901234567890.01"},
+	map[string]any{"$bytes": "AQI="},
+	map[string]any{"$raw": "NULL"},
+}
+
+type fuzzFailure struct {
+	kind   string // "syntax" / "render"
+	msg    string
+	params map[string]any
+	sql    string
+}
+
+func fuzzCmd(args []string) {
+	fs := flag.NewFlagSet("fuzz", flag.ExitOnError)
+	var srcDir, drvOpt, dsnOpt, confPath, seedPath string
+	var iterations, maxFailures, timeout int
+	var randSeed uint64
+	var noExec, failOnRender bool
+	fs.StringVar(&srcDir, "src", "./sql", "SQL template file or directory to fuzz (*.sql, recursive; *.expected*.sql and the -seed file are skipped)")
+	fs.IntVar(&iterations, "n", 1000, "random param maps per template")
+	fs.Uint64Var(&randSeed, "rand-seed", 0, "random seed (0 = time based; printed for reproduction)")
+	fs.StringVar(&drvOpt, "driver", "", "override driver: mysql|postgres|sqlite|duckdb")
+	fs.StringVar(&dsnOpt, "dsn", "", "override DSN")
+	fs.StringVar(&confPath, "nyanconf", "", "path to NyanQL config.json")
+	fs.StringVar(&seedPath, "seed", "", "SQL file executed before each query in the same transaction (e.g. schema)")
+	fs.BoolVar(&noExec, "noexec", false, "render only; report render errors without executing")
+	fs.BoolVar(&failOnRender, "fail-on-render", false, "exit 1 on render errors too (default: only syntax errors)")
+	fs.IntVar(&maxFailures, "max-failures", 5, "distinct failures reported per template")
+	fs.IntVar(&timeout, "timeout", 30, "timeout in seconds per execution")
+	_ = fs.Parse(args)
+
+	conf, err := loadNyanConf(confPath)
+	die(err)
+	if dsnOpt != "" {
+		dsnOpt, err = expandEnv(dsnOpt, false)
+		die(err)
+	}
+	drv, effDSN, err := resolveDB(conf, drvOpt, dsnOpt)
+	die(err)
+	dialect := dialectName(drv)
+
+	var seed string
+	if seedPath != "" {
+		b, err := os.ReadFile(seedPath)
+		die(err)
+		seed = string(b)
+	}
+	if randSeed == 0 {
+		randSeed = uint64(time.Now().UnixNano())
+	}
+
+	// テンプレート以外（expected と seed）は対象外
+	seedAbs, _ := filepath.Abs(seedPath)
+	var files []string
+	die(filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(info.Name())
+		if info.IsDir() || !strings.HasSuffix(name, ".sql") || strings.Contains(name, ".expected.") {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); seedPath != "" && abs == seedAbs {
+			return nil
+		}
+		files = append(files, p)
+		return nil
+	}))
+	sort.Strings(files)
+
+	var db *sql.DB
+	if !noExec {
+		db, err = sql.Open(drv, effDSN)
+		die(err)
+		defer db.Close()
+		applyPool(db, conf)
+	}
+	// ロールバック前提で1回実行（同じ SQL は結果を使い回す）
+	execCache := map[string]error{}
+	exec := func(q string) error {
+		if err, ok := execCache[q]; ok {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+		defer cancel()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			die(err)
+		}
+		defer tx.Rollback()
+		if seed != "" {
+			if err := execBatch(ctx, tx, dialect, seed); err != nil {
+				die(fmt.Errorf("seed: %w", err))
+			}
+		}
+		err = execBatch(ctx, tx, dialect, q)
+		execCache[q] = err
+		return err
+	}
+
+	fmt.Printf("fuzz: driver=%s rand-seed=%d n=%d\n", drv, randSeed, iterations)
+	total, renderErrs := 0, 0
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		die(err)
+		clear(execCache)
+		fails, distinct := fuzzTemplate(string(b), dialect, iterations, maxFailures, randSeed, exec, noExec)
+		nRender := 0
+		for _, ff := range fails {
+			if ff.kind == "render" {
+				nRender++
+			}
+		}
+		total += len(fails) - nRender
+		renderErrs += nRender
+		fmt.Printf("%s: %d distinct SQL, %d failure(s), %d render error(s)\n", filepath.ToSlash(f), distinct, len(fails)-nRender, nRender)
+		for i, ff := range fails {
+			pj, _ := json.Marshal(ff.params)
+			fmt.Printf("  %d) %s error: %s\n     params: %s\n", i+1, ff.kind, ff.msg, pj)
+			if ff.sql != "" {
+				fmt.Printf("     sql: %s\n", abbrev(strings.Join(strings.Fields(ff.sql), " "), 300))
+			}
+		}
+	}
+	fmt.Printf("\n%d file(s), %d failure(s), %d render error(s) (rand-seed=%d)\n", len(files), total, renderErrs, randSeed)
+	if total > 0 || failOnRender && renderErrs > 0 {
+		os.Exit(1)
+	}
+}
+
+// 1テンプレートをランダムな params で繰り返しレンダリング（と実行）し、
+// 失敗した params をキーを減らせるだけ減らしてから返す
+func fuzzTemplate(tpl, dialect string, iterations, maxFailures int, randSeed uint64, exec func(string) error, noExec bool) ([]fuzzFailure, int) {
+	set := map[string]bool{}
+	defaults := guessParamsFromSQL(tpl)
+	for k := range defaults {
+		set[k] = true
+	}
+	for _, k := range findTruthyKeysForVariants(tpl) {
+		set[k] = true
+	}
+	for k := range templateKeys(tpl) {
+		set[k] = true
+	}
+	keys := slices.Sorted(maps.Keys(set))
+
+	check := func(p map[string]any) fuzzFailure {
+		q, err := renderNyanSQLWith(tpl, p, dialect, nil)
+		if err != nil {
+			return fuzzFailure{kind: "render", msg: err.Error()}
+		}
+		if noExec || strings.TrimSpace(q) == "" {
+			return fuzzFailure{}
+		}
+		if err := exec(q); err != nil && isSyntaxError(err) {
+			return fuzzFailure{kind: "syntax", msg: err.Error(), sql: q}
+		}
+		return fuzzFailure{}
+	}
+
+	rng := rand.New(rand.NewPCG(randSeed, uint64(len(tpl))))
+	seen := map[string]bool{}
+	distinct := map[string]bool{}
+	var out []fuzzFailure
+	for range iterations {
+		p := map[string]any{}
+		for _, k := range keys {
+			n := len(fuzzValues)
+			if d, ok := defaults[k]; ok && d != "" {
+				n++ // SQL 上のデフォルト値も候補にする
+			}
+			i := rng.IntN(n)
+			switch {
+			case i == len(fuzzValues):
+				p[k] = defaults[k]
+			case fuzzValues[i] != fuzzAbsent:
+				p[k] = fuzzValues[i]
+			}
+		}
+		if q, err := renderNyanSQLWith(tpl, p, dialect, nil); err == nil {
+			distinct[q] = true
+		}
+		ff := check(p)
+		if ff.kind == "" {
+			continue
+		}
+		// キーを1つずつ外しても同じ種類の失敗になるなら外す
+		for _, k := range keys {
+			v, ok := p[k]
+			if !ok {
+				continue
+			}
+			delete(p, k)
+			if f2 := check(p); f2.kind == ff.kind {
+				ff = f2
+			} else {
+				p[k] = v
+			}
+		}
+		ff.params = p
+		// 値だけが違う同じ失敗はまとめる（キーの組と失敗の種類で判定）
+		if sig := ff.kind + " " + strings.Join(slices.Sorted(maps.Keys(p)), ","); !seen[sig] {
+			seen[sig] = true
+			out = append(out, ff)
+			if len(out) >= maxFailures {
+				break
+			}
+		}
+	}
+	return out, len(distinct)
+}
+
 /* ============== Generator helpers ============== */
 
 func guessParamsFromSQL(sqlContent string) map[string]any {
@@ -1688,6 +5817,13 @@ func readTestDef(path string) (TestDef, error) {
 	if err := json.Unmarshal([]byte(s), &td); err != nil {
 		return TestDef{}, err
 	}
+	// "result": false / "response": false は出力しない
+	if td.Result != nil && td.Result.disabled {
+		td.Result = nil
+	}
+	if td.Response != nil && td.Response.disabled {
+		td.Response = nil
+	}
 	return td, nil
 }
 
@@ -1726,6 +5862,15 @@ func fileNotExists(p string) bool {
 	return os.IsNotExist(err)
 }
 
+func firstPositive(vs ...int) int {
+	for _, v := range vs {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
 func firstNonEmpty(a, b string) string {
 	if strings.TrimSpace(a) != "" {
 		return a
@@ -1789,6 +5934,15 @@ func toString(v any) string {
 	}
 }
 
+// 長い文字列を n 文字（rune）で切り詰める
+func abbrev(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
 func addNewline(s string) string {
 	if strings.HasSuffix(s, "\n") {
 		return s
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitBySemicolon(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		in      string
+		want    []string
+	}{
+		{"plain", "sqlite", "SELECT 1; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"trailing semicolon", "sqlite", "SELECT 1;", []string{"SELECT 1", ""}},
+		{"single quote", "sqlite", "SELECT 'a;b'; SELECT 2", []string{"SELECT 'a;b'", "SELECT 2"}},
+		{"doubled quote", "sqlite", "SELECT 'a'';b'; SELECT 2", []string{"SELECT 'a'';b'", "SELECT 2"}},
+		{"double quote", "sqlite", `SELECT "a;b"; SELECT 2`, []string{`SELECT "a;b"`, "SELECT 2"}},
+		{"backtick", "mysql", "SELECT `a;b`; SELECT 2", []string{"SELECT `a;b`", "SELECT 2"}},
+		{"line comment", "sqlite", "SELECT 1 -- a;b\n; SELECT 2", []string{"SELECT 1 -- a;b\n", "SELECT 2"}},
+		{"block comment", "sqlite", "SELECT 1 /* a;b */; SELECT 2", []string{"SELECT 1 /* a;b */", "SELECT 2"}},
+
+		// mysql: \ は文字列中のエスケープ、# はコメント
+		{"mysql backslash", "mysql", `SELECT 'a\';b'; SELECT 2`, []string{`SELECT 'a\';b'`, "SELECT 2"}},
+		{"mysql backslash in double quote", "mysql", `SELECT "a\";b"; SELECT 2`, []string{`SELECT "a\";b"`, "SELECT 2"}},
+		{"mysql escaped backslash", "mysql", `SELECT 'a\\'; SELECT 2`, []string{`SELECT 'a\\'`, "SELECT 2"}},
+		{"mysql hash comment", "mysql", "SELECT 1 # a;b\n; SELECT 2", []string{"SELECT 1 # a;b\n", "SELECT 2"}},
+		{"backslash is literal outside mysql", "postgres", `SELECT 'a\'; SELECT 2`, []string{`SELECT 'a\'`, "SELECT 2"}},
+		{"hash is not a comment outside mysql", "sqlite", "SELECT 1 # 2; SELECT 3", []string{"SELECT 1 # 2", "SELECT 3"}},
+
+		// postgres / duckdb: $tag$...$tag$ と E'...'
+		{"dollar quote", "postgres", "SELECT $$a;b$$; SELECT 2", []string{"SELECT $$a;b$$", "SELECT 2"}},
+		{"tagged dollar quote", "postgres", "DO $fn$ BEGIN x := 1; y := $$;$$; END $fn$; SELECT 2", []string{"DO $fn$ BEGIN x := 1; y := $$;$$; END $fn$", "SELECT 2"}},
+		{"dollar quote duckdb", "duckdb", "SELECT $q$a;b$q$; SELECT 2", []string{"SELECT $q$a;b$q$", "SELECT 2"}},
+		{"positional parameter", "postgres", "SELECT $1; SELECT $2", []string{"SELECT $1", "SELECT $2"}},
+		{"dollar inside identifier", "postgres", "SELECT a$b$; SELECT 2", []string{"SELECT a$b$", "SELECT 2"}},
+		{"escape string", "postgres", `SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{"identifier ending in e", "postgres", `SELECT name'a\'; SELECT 2`, []string{`SELECT name'a\'`, "SELECT 2"}},
+		{"dollar is literal in mysql", "mysql", "SELECT $$; SELECT 2", []string{"SELECT $$", "SELECT 2"}},
+
+		{"unterminated quote", "sqlite", "SELECT 'a;b", []string{"SELECT 'a;b"}},
+		{"unterminated dollar quote", "postgres", "SELECT $$a;b", []string{"SELECT $$a;b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitBySemicolon(tt.in, tt.dialect)
+			for i := range got {
+				got[i] = strings.TrimSpace(got[i])
+			}
+			want := slices.Clone(tt.want)
+			for i := range want {
+				want[i] = strings.TrimSpace(want[i])
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("splitBySemicolon(%q, %q)\n got: %q\nwant: %q", tt.in, tt.dialect, got, want)
+			}
+		})
+	}
+}
+
+func TestSqlShape(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		in      string
+		want    []string
+	}{
+		{"tokens", "sqlite", "SELECT id FROM t WHERE a = 'x' AND b = 1", []string{"word:SELECT", "word:ID", "word:FROM", "word:T", "word:WHERE", "word:A", "=", "string", "word:AND", "word:B", "=", "number"}},
+		{"doubled quote", "sqlite", "'a''b'", []string{"string"}},
+		{"double quote is ident", "sqlite", `"a"`, []string{"ident"}},
+		{"double quote is string in mysql", "mysql", `"a"`, []string{"string"}},
+		{"backtick", "mysql", "`a`", []string{"ident"}},
+		{"mysql backslash", "mysql", `'a\'b'`, []string{"string"}},
+		{"backslash is literal outside mysql", "postgres", `'a\' OR 1`, []string{"string", "word:OR", "number"}},
+		{"postgres escape string", "postgres", `E'a\'b'`, []string{"string"}},
+		{"line comment", "sqlite", "1 -- x\n2", []string{"number", "comment", "number"}},
+		{"block comment", "sqlite", "1 /* x */ 2", []string{"number", "comment", "number"}},
+		{"mysql hash comment", "mysql", "1 # x", []string{"number", "comment"}},
+		{"hash outside mysql", "sqlite", "1 # x", []string{"number", "#", "word:X"}},
+		{"unterminated string", "sqlite", "'abc", []string{"unterminated '"}},
+		{"unterminated comment", "sqlite", "1 /* x", []string{"number", "unterminated comment"}},
+		{"injected", "sqlite", "a = '' OR '1'='1'", []string{"word:A", "=", "string", "word:OR", "string", "=", "string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sqlShape(tt.in, tt.dialect); !slices.Equal(got, tt.want) {
+				t.Errorf("sqlShape(%q, %q)\n got: %q\nwant: %q", tt.in, tt.dialect, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchIgnoresToolWrites(t *testing.T) {
+	dir := t.TempDir()
+	exp := filepath.Join(dir, "a.expected.sql")
+	src := filepath.Join(dir, "a.sql")
+	for _, p := range []string{exp, src} {
+		if err := os.WriteFile(p, []byte("SELECT 1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths := []string{exp, src}
+	stamps := map[string]fileStamp{}
+	statFiles(stamps, paths)
+	clear(writtenFiles)
+
+	// 同じ内容は書き直さない
+	if err := writeSnapshotFile(exp, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(writtenFiles) != 0 {
+		t.Fatalf("unchanged snapshot was rewritten: %v", writtenFiles)
+	}
+
+	// ツールが書き出したファイルは実行後に取り直すので変更にならない
+	if err := writeSnapshotFile(exp, "SELECT 1, 2"); err != nil {
+		t.Fatal(err)
+	}
+	restampWritten(stamps)
+	cur := map[string]fileStamp{}
+	statFiles(cur, paths)
+	if changed := changedFiles(stamps, cur); len(changed) != 0 {
+		t.Fatalf("tool write reported as change: %v", changed)
+	}
+
+	// 利用者の編集は変更になる
+	if err := os.WriteFile(src, []byte("SELECT 2, 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	restampWritten(stamps)
+	cur = map[string]fileStamp{}
+	statFiles(cur, paths)
+	if changed := changedFiles(stamps, cur); !changed[src] || len(changed) != 1 {
+		t.Fatalf("changedFiles = %v, want only %s", changed, src)
+	}
+}
+
+func TestLintNestedBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		tpl  string
+		want []string // nested-block のメッセージ
+	}{
+		{"begin in if", "SELECT * FROM t\n/*IF x*/ WHERE a=1 /*BEGIN*/ AND b = /*b*/2 /*END*/ AND c = 3 /*END*/", []string{"BEGIN inside IF"}},
+		{"if in if", "SELECT * FROM t /*IF x*/ WHERE /*IF y*/ a = 1 /*END*/ /*END*/", []string{"IF inside IF"}},
+		{"begin in begin", "SELECT * FROM t /*BEGIN*/ WHERE /*BEGIN*/ a = /*a*/1 /*END*/ /*END*/", []string{"BEGIN inside BEGIN"}},
+		{"if in begin", "SELECT * FROM t /*BEGIN*/ WHERE /*IF x*/ a = 1 /*END*/ /*END*/", nil},
+		{"optional in if", "SELECT * FROM t /*IF x*/ WHERE 1 = 1 /*? b ?*/ AND b = /*b*/2 /*?*/ /*END*/", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range lintTemplate("t.sql", tt.tpl) {
+				if f.Rule == "nested-block" {
+					got = append(got, f.Message)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("nested-block findings = %q, want %d", got, len(tt.want))
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("finding %d = %q, want prefix %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParamDefaultsRoundTrip(t *testing.T) {
+	tpl := "SELECT * FROM t WHERE s = /*s*/'abc' AND n = /*n*/10 AND f = /*f*/1.5 AND b = /*b*/true" +
+		" AND d1 = /*d1*/12345678901234567890.01 AND d2 = /*d2*/+0.10000000000000000001"
+	defs := extractParamDefaults(tpl)
+	path := filepath.Join(t.TempDir(), "p.jsonc")
+	if err := writeParamsJSONC(path, defs, "test"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := decodeParams(b)
+	if err != nil {
+		t.Fatalf("decodeParams: %v\n%s", err, b)
+	}
+	want := map[string]any{
+		"s":  "abc",
+		"n":  json.Number("10"),
+		"f":  json.Number("1.5"),
+		"b":  true,
+		"d1": map[string]any{"$decimal": "12345678901234567890.01"},
+		"d2": map[string]any{"$decimal": "+0.10000000000000000001"},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Fatalf("decoded params = %#v\nwant %#v", params, want)
+	}
+	// 生成した params でレンダリングしても、デフォルト値のままと同じ SQL になる
+	for _, dialect := range []string{"", "postgres", "mysql"} {
+		got, err := renderNyanSQLWith(tpl, params, dialect, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base, err := renderNyanSQLWith(tpl, map[string]any{}, dialect, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != base {
+			t.Errorf("dialect %q: rendered with generated params\n got: %s\nwant: %s", dialect, got, base)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("NYANTEST_A", "x")
+	t.Setenv("NYANTEST_EMPTY", "")
+	t.Setenv("NYANTEST_Q", `a"b\`)
+	tests := []struct {
+		name    string
+		in      string
+		inJSON  bool
+		want    string
+		wantErr string
+	}{
+		{"value", "${NYANTEST_A}", false, "x", ""},
+		{"embedded", "pre-${NYANTEST_A}-post", false, "pre-x-post", ""},
+		{"default unused", "${NYANTEST_A:-d}", false, "x", ""},
+		{"default unset", "${NYANTEST_UNSET:-d}", false, "d", ""},
+		{"default empty", "${NYANTEST_EMPTY:-d}", false, "d", ""},
+		{"empty without default", "${NYANTEST_EMPTY}", false, "", ""},
+		{"no braces", "$NYANTEST_A", false, "$NYANTEST_A", ""},
+		{"raw outside JSON", "${NYANTEST_Q}", false, `a"b\`, ""},
+		{"escaped in JSON", "${NYANTEST_Q}", true, `a\"b\\`, ""},
+		{"default escaped in JSON", `${NYANTEST_UNSET:-C:\tmp}`, true, `C:\\tmp`, ""},
+		{"undefined", "${NYANTEST_U1} ${NYANTEST_U2} ${NYANTEST_U1}", false, "", "NYANTEST_U1, NYANTEST_U2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv(tt.in, tt.inJSON)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandEnv(%q) error = %v, want it to mention %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEnv(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("expandEnv(%q, %v) = %q, want %q", tt.in, tt.inJSON, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypedLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		in      map[string]any
+		want    string
+		ok      bool
+		wantErr bool
+	}{
+		{"date sqlite", "sqlite", map[string]any{"$date": "2024-01-02"}, "'2024-01-02'", true, false},
+		{"date postgres", "postgres", map[string]any{"$date": "2024-01-02"}, "DATE '2024-01-02'", true, false},
+		{"date invalid", "postgres", map[string]any{"$date": "2024-13-02"}, "", true, true},
+		{"timestamp to UTC", "mysql", map[string]any{"$timestamp": "2024-01-02T03:04:05+09:00"}, "TIMESTAMP '2024-01-01 18:04:05'", true, false},
+		{"timestamp invalid", "mysql", map[string]any{"$timestamp": "yesterday"}, "", true, true},
+		{"decimal", "postgres", map[string]any{"$decimal": "12.50"}, "12.50", true, false},
+		{"decimal exponent", "postgres", map[string]any{"$decimal": "-1.5e3"}, "-1.5e3", true, false},
+		{"decimal invalid", "postgres", map[string]any{"$decimal": "1; DROP"}, "", true, true},
+		{"bytes sqlite", "sqlite", map[string]any{"$bytes": "AQI="}, "X'0102'", true, false},
+		{"bytes postgres", "postgres", map[string]any{"$bytes": "AQI="}, `'\x0102'::bytea`, true, false},
+		{"bytes duckdb", "duckdb", map[string]any{"$bytes": "AQI="}, `'\x01\x02'::BLOB`, true, false},
+		{"bytes invalid", "sqlite", map[string]any{"$bytes": "!!"}, "", true, true},
+		{"raw", "postgres", map[string]any{"$raw": "now()"}, "now()", true, false},
+		{"not a string", "sqlite", map[string]any{"$date": 1}, "", true, true},
+		{"unknown key", "sqlite", map[string]any{"$foo": "x"}, "", false, false},
+		{"plain object", "sqlite", map[string]any{"$date": "2024-01-02", "x": 1}, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := typedLiteral(tt.dialect, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("typedLiteral(%q, %v) error = %v, wantErr %v", tt.dialect, tt.in, err, tt.wantErr)
+			}
+			if ok != tt.ok || err == nil && got != tt.want {
+				t.Errorf("typedLiteral(%q, %v) = %q, %v; want %q, %v", tt.dialect, tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpectedPathResolution(t *testing.T) {
+	dir := t.TempDir()
+	common := filepath.Join(dir, "a.expected.sql")
+	pg := filepath.Join(dir, "a.expected.postgres.sql")
+	writeTestFile(t, common, "SELECT 'a'\n")
+	writeTestFile(t, pg, "SELECT E'a'\n")
+
+	if got := dialectExpectedPath(common, "mysql"); got != filepath.Join(dir, "a.expected.mysql.sql") {
+		t.Errorf("dialectExpectedPath = %q", got)
+	}
+	if got := resolveExpectedPath(common, "postgres"); got != pg {
+		t.Errorf("resolveExpectedPath(postgres) = %q, want %q", got, pg)
+	}
+	if got := resolveExpectedPath(common, "mysql"); got != common {
+		t.Errorf("resolveExpectedPath(mysql) = %q, want the common file", got)
+	}
+
+	// dialect 別があればそちらと比べる
+	if err := compareExpected(common, "postgres", "SELECT E'a'"); err != nil {
+		t.Errorf("postgres: %v", err)
+	}
+	if err := compareExpected(common, "mysql", "SELECT 'a'"); err != nil {
+		t.Errorf("mysql: %v", err)
+	}
+	if err := compareExpected(common, "mysql", "SELECT E'a'"); err == nil {
+		t.Error("mysql: mismatch against the common expected not reported")
+	}
+
+	// -expected-dialect -auto-expected でも、共通の expected と一致するなら dialect 別を作らない
+	defer func(a, d bool) { autoExpected, dialectExp = a, d }(autoExpected, dialectExp)
+	autoExpected, dialectExp = true, true
+	if err := compareExpected(common, "sqlite", "SELECT 'a'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.expected.sqlite.sql")); !os.IsNotExist(err) {
+		t.Error("dialect expected written although the common one matches")
+	}
+	if err := compareExpected(common, "duckdb", "SELECT 'b'"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "a.expected.duckdb.sql")); err != nil || string(b) != "SELECT 'b'\n" {
+		t.Errorf("dialect expected = %q, %v", b, err)
+	}
+}
+
+func TestLoadSteps(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, cfg, `{
+	  "ok": {
+	    "params": {"k": 1},
+	    "steps": [
+	      {"name": "ins", "sql": "ins.sql", "expected": "ins.expected.sql"},
+	      {"sql": "sel.sql", "params": {"k": 2}},
+	      {"sql": "del.sql", "params": "del.jsonc"}
+	    ]
+	  }
+	}`)
+	tests, err := loadTests(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 1 || len(tests[0].Steps) != 3 {
+		t.Fatalf("loaded %+v", tests)
+	}
+	st := tests[0].Steps
+	if st[0].SQLPath != filepath.Join(dir, "ins.sql") || st[0].Expected != filepath.Join(dir, "ins.expected.sql") {
+		t.Errorf("step 1 paths = %q, %q", st[0].SQLPath, st[0].Expected)
+	}
+	// params を省略した step はテストの params
+	if !reflect.DeepEqual(st[0].ParamsInline, map[string]any{"k": float64(1)}) {
+		t.Errorf("step 1 params = %v", st[0].ParamsInline)
+	}
+	if !reflect.DeepEqual(st[1].ParamsInline, map[string]any{"k": float64(2)}) {
+		t.Errorf("step 2 params = %v", st[1].ParamsInline)
+	}
+	if st[2].ParamsPath != filepath.Join(dir, "del.jsonc") || st[2].ParamsInline != nil {
+		t.Errorf("step 3 params = %q, %v", st[2].ParamsPath, st[2].ParamsInline)
+	}
+	if got := stepLabel(1, st[1]); got != "step 2 (sel)" {
+		t.Errorf("stepLabel = %q", got)
+	}
+
+	for _, tt := range []struct{ def, wantErr string }{
+		{`{"t": {"sql": "a.sql", "params": {}, "steps": [{"sql": "b.sql"}]}}`, "cannot combine 'steps'"},
+		{`{"t": {"params": {}, "steps": [{"name": "x"}]}}`, "step 1: missing sql"},
+		{`{"t": {"steps": [{"sql": "b.sql"}]}}`, "step 1: missing params"},
+	} {
+		writeTestFile(t, cfg, tt.def)
+		if _, err := loadTests(cfg, dir); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loadTests(%s) error = %v, want it to mention %q", tt.def, err, tt.wantErr)
+		}
+	}
+}
+
+type fakeResult struct{ id, n int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.n, nil }
+
+func TestApplyCapture(t *testing.T) {
+	rs := resultSet{
+		Columns: []string{"id", "name"},
+		Rows:    []map[string]any{{"id": int64(7), "name": "a"}, {"id": int64(8), "name": "b"}},
+	}
+	vars := map[string]any{}
+	err := applyCapture(map[string]string{"first": "$.rows[0].id", "second": " $.rows[1].name "}, nil, rs, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// params と同じ型（数値は json.Number）
+	if want := map[string]any{"first": json.Number("7"), "second": "b"}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %#v, want %#v", vars, want)
+	}
+
+	vars = map[string]any{}
+	if err := applyCapture(map[string]string{"id": "$.lastInsertId", "n": "$.rowsAffected"}, fakeResult{42, 1}, resultSet{}, vars); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"id": json.Number("42"), "n": json.Number("1")}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %#v, want %#v", vars, want)
+	}
+
+	for _, tt := range []struct {
+		path    string
+		wantErr string
+	}{
+		{"$.rows[2].id", "only 2 row(s) returned"},
+		{"$.rows[0].missing", `no column "missing"`},
+		{"$.lastInsertId", "no result"},
+		{"rows[0].id", "unsupported path"},
+	} {
+		err := applyCapture(map[string]string{"k": tt.path}, nil, rs, map[string]any{})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("applyCapture(%q) error = %v, want it to mention %q", tt.path, err, tt.wantErr)
+		}
+	}
+
+	if !captureNeedsRows(map[string]string{"a": "$.lastInsertId", "b": " $.rows[0].id"}) {
+		t.Error("captureNeedsRows: $.rows not detected")
+	}
+	if captureNeedsRows(map[string]string{"a": "$.rowsAffected", "b": "$.lastInsertId"}) {
+		t.Error("captureNeedsRows: $.rowsAffected taken as $.rows")
+	}
+
+	// $.rows と lastInsertId / rowsAffected は同じ step で使えない（rowsAffected だけなら使える）
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, cfg, `{"t": {"params": {}, "steps": [{"sql": "a.sql", "capture": {"id": "$.rows[0].id", "n": "$.rowsAffected"}}]}}`)
+	if _, err := loadTests(cfg, dir); err == nil || !strings.Contains(err.Error(), "cannot be combined with $.rows") {
+		t.Errorf("loadTests error = %v", err)
+	}
+	writeTestFile(t, cfg, `{"t": {"params": {}, "steps": [{"sql": "a.sql", "capture": {"n": "$.rowsAffected"}}]}}`)
+	if _, err := loadTests(cfg, dir); err != nil {
+		t.Errorf("loadTests with $.rowsAffected only: %v", err)
+	}
+}
+
+func TestTemplateCoverage(t *testing.T) {
+	tpl := "SELECT * FROM t\n" +
+		"/*BEGIN*/WHERE\n" +
+		"/*IF a*/ a = /*a*/1 /*END*/\n" +
+		"/*? b ?*/ AND b = /*b*/2 /*?*/\n" +
+		"/*END*/"
+	c := newTemplateCoverage()
+	for _, params := range []map[string]any{{"a": true, "b": nil}, {"a": false, "b": nil}} {
+		if _, err := renderNyanSQLWith(tpl, params, "", &renderTrace{blocks: c.recorder("a.sql", tpl)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := c.report()
+	// IF は両方、OPTIONAL は落ちただけ、BEGIN は展開（a=true）と落ちる（a=false で中身が WHERE だけ）の両方
+	if r.Branches != 6 || r.Covered != 5 {
+		t.Errorf("covered %d/%d branches, want 5/6", r.Covered, r.Branches)
+	}
+	if got := r.String(); !strings.Contains(got, "a.sql:4 OPTIONAL b: never rendered") || strings.Contains(got, "IF a") {
+		t.Errorf("report:\n%s", got)
+	}
+	lcov := r.lcov()
+	for _, want := range []string{"SF:a.sql", "BRDA:4,2,0,0", "BRDA:4,2,1,2", "BRF:6", "BRH:5", "end_of_record"} {
+		if !strings.Contains(lcov, want) {
+			t.Errorf("lcov has no %q:\n%s", want, lcov)
+		}
+	}
+}
+
+func TestParamUsage(t *testing.T) {
+	tpl := "SELECT * FROM t WHERE a = /*a*/1 AND b = /*b*/'x'\n/*IF c = d*/ AND c = 1 /*END*/\n/*? e ?*/ AND e = 1 /*?*/"
+	if got, want := slices.Sorted(maps.Keys(templateKeys(tpl))), []string{"a", "b", "c", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("templateKeys = %q, want %q", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "a.sql")
+	writeTestFile(t, path, tpl)
+	pu := newParamUsage()
+	if _, err := renderTemplate(path, "", map[string]any{"a": 2, "c": 1, "d": 1, "zz": 1}, nil, "", pu); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pu.issues(), "unused params: zz\ndefaulted placeholders: b"; got != want {
+		t.Errorf("issues = %q, want %q", got, want)
+	}
+
+	// capture の値は params ではないので未使用に数えない
+	pu = newParamUsage()
+	if _, err := renderTemplate(path, "", map[string]any{"a": 2, "b": "y", "c": 1, "d": 1, "e": true}, map[string]any{"cap": 1}, "", pu); err != nil {
+		t.Fatal(err)
+	}
+	if got := pu.issues(); got != "" {
+		t.Errorf("issues = %q, want none", got)
+	}
+}
+
+func TestLeftoverPlaceholders(t *testing.T) {
+	tpl := "SELECT * FROM t\nWHERE d = /*d*/CURRENT_DATE AND a = /*a*/1\n/*IF x*/ AND e = /*e*/now() /*END*/"
+	tr := &renderTrace{defaulted: map[string]bool{}, leftover: map[string]bool{}}
+	got, err := renderNyanSQLWith(tpl, map[string]any{"a": json.Number("2")}, "", tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "/*d*/CURRENT_DATE") || !strings.Contains(got, "a = 2") {
+		t.Errorf("rendered %q", got)
+	}
+	// IF で落ちたブロックの中は数えない
+	if want := map[string]bool{"/*d*/ (line 2)": true}; !reflect.DeepEqual(tr.leftover, want) {
+		t.Errorf("leftover = %v, want %v", tr.leftover, want)
+	}
+
+	// params に値があるのに置換できない場合はエラー
+	_, err = renderNyanSQLWith(tpl, map[string]any{"d": "2024-01-01", "x": true}, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "params value ignored: /*d*/ (line 2)") {
+		t.Errorf("error = %v", err)
+	}
+
+	// lint も同じプレースホルダを報告する
+	var rules []string
+	for _, f := range lintTemplate("a.sql", tpl) {
+		rules = append(rules, fmt.Sprintf("%d:%s", f.Line, f.Rule))
+	}
+	if want := []string{"2:placeholder-no-default", "3:placeholder-no-default"}; !slices.Equal(rules, want) {
+		t.Errorf("lint findings = %q, want %q", rules, want)
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, cfg, `{
+	  "bool":    {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "skip": true},
+	  "reason":  {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "skip": "skipped"},
+	  "off":     {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "skip": false},
+	  "todo":    {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "todo": true, "skip": true},
+	  "todoWhy": {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "todo": true, "skip": "later"},
+	  "pgOnly":  {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "drivers": ["postgres"]}
+	}`)
+	tests, err := loadTests(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"bool":    "skipped",
+		"reason":  "skipped",
+		"off":     "",
+		"todo":    "todo",
+		"todoWhy": "todo: later",
+		"pgOnly":  "driver sqlite not in drivers [postgres]",
+	}
+	for _, tc := range tests {
+		if got := skipReason(tc, "sqlite"); got != want[tc.Name] {
+			t.Errorf("%s: skipReason = %q, want %q", tc.Name, got, want[tc.Name])
+		}
+	}
+	// 理由が "skipped" でも skip: true と区別できる
+	for _, tc := range tests {
+		if tc.Name == "reason" && tc.SkipReason != "skipped" || tc.Name == "bool" && tc.SkipReason != "" {
+			t.Errorf("%s: SkipReason = %q", tc.Name, tc.SkipReason)
+		}
+	}
+	if got := skipReason(tests[slices.IndexFunc(tests, func(tc TestCase) bool { return tc.Name == "pgOnly" })], "pgx"); got != "" {
+		t.Errorf("pgOnly on pgx: skipReason = %q", got)
+	}
+}
+
+// 接続を壊せるだけの database/sql ドライバ（共有の接続の張り替えの確認用）
+type fakeDriver struct{ opened, broken int }
+
+type fakeConn struct {
+	d  *fakeDriver
+	id int
+}
+
+func (d *fakeDriver) Open(string) (sqldriver.Conn, error) {
+	d.opened++
+	return &fakeConn{d: d, id: d.opened}, nil
+}
+func (c *fakeConn) Prepare(string) (sqldriver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                           { return nil }
+func (c *fakeConn) Begin() (sqldriver.Tx, error)           { return nil, errors.New("not supported") }
+func (c *fakeConn) Ping(context.Context) error {
+	if c.id == c.d.broken {
+		return sqldriver.ErrBadConn
+	}
+	return nil
+}
+
+var testFakeDriver = &fakeDriver{}
+
+func init() { sql.Register("nyantest-fake", testFakeDriver) }
+
+func TestSessionRepin(t *testing.T) {
+	sess, err := openSession("nyantest-fake", "", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if ok, err := sess.repin(time.Second); ok || err != nil {
+		t.Fatalf("healthy connection replaced: %v, %v", ok, err)
+	}
+	// タイムアウトで閉じられた接続の代わり
+	testFakeDriver.broken = testFakeDriver.opened
+	if ok, err := sess.repin(time.Second); !ok || err != nil {
+		t.Fatalf("repin = %v, %v, want a new connection", ok, err)
+	}
+	if err := sess.conn.PingContext(context.Background()); err != nil {
+		t.Errorf("new connection: %v", err)
+	}
+
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, filepath.Join(dir, "s.sql"), "SET x = 1")
+	writeTestFile(t, cfg, `{"beforeAll": ["s.sql", {"sql": "s.sql", "reconnect": true}]}`)
+	h, err := loadHooks(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.BeforeAll) != 2 || h.BeforeAll[0].reconnect || !h.BeforeAll[1].reconnect {
+		t.Errorf("beforeAll = %+v", h.BeforeAll)
+	}
+	writeTestFile(t, cfg, `{"beforeEach": [{"sql": "s.sql", "reconnect": true}]}`)
+	if _, err := loadHooks(cfg, dir); err == nil || !strings.Contains(err.Error(), "only for beforeAll") {
+		t.Errorf("loadHooks error = %v", err)
+	}
+}
+
+func TestLoadPlanSpec(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, cfg, `{
+	  "off":  {"sql": "a.sql", "expected": "sql/a.expected.sql", "params": {}, "plan": false},
+	  "null": {"sql": "a.sql", "expected": "sql/a.expected.sql", "params": {}, "plan": null},
+	  "on":   {"sql": "a.sql", "expected": "sql/a.expected.sql", "params": {}, "plan": true},
+	  "obj":  {"sql": "a.sql", "expected": "sql/a.expected.sql", "params": {}, "plan": {"forbidFullScan": true, "snapshot": "p.txt"}}
+	}`)
+	tests, err := loadTests(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans := map[string]*PlanSpec{}
+	for _, tc := range tests {
+		plans[tc.Name] = tc.Plan
+	}
+	if plans["off"] != nil || plans["null"] != nil {
+		t.Errorf("plan false/null not disabled: %+v, %+v", plans["off"], plans["null"])
+	}
+	if p := plans["on"]; p == nil || p.Snapshot != filepath.Join(dir, "sql", "a.plan.txt") || p.ForbidFullScan {
+		t.Errorf("plan true = %+v", p)
+	}
+	if p := plans["obj"]; p == nil || p.Snapshot != filepath.Join(dir, "p.txt") || !p.ForbidFullScan {
+		t.Errorf("plan object = %+v", p)
+	}
+
+	writeTestFile(t, cfg, `{"t": {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "plan": "yes"}}`)
+	if _, err := loadTests(cfg, dir); err == nil || !strings.Contains(err.Error(), "invalid 'plan'") {
+		t.Errorf("loadTests error = %v", err)
+	}
+}
+
+func TestResultTimezone(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "test.json")
+	writeTestFile(t, cfg, `{"t": {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "result": {"timezone": "Asia/Tokyo"}}}`)
+	tests, err := loadTests(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := tests[0].Result
+	if spec == nil || spec.loc == nil || spec.loc.String() != "Asia/Tokyo" {
+		t.Fatalf("result = %+v", spec)
+	}
+	// TZ なしの値は Asia/Tokyo とみなして比べる
+	if !valueEqual("2024-01-01 09:00:00", "2024-01-01T00:00:00Z", spec) {
+		t.Error("same instant not equal")
+	}
+	if valueEqual("2024-01-01 00:00:00", "2024-01-01T00:00:00Z", spec) {
+		t.Error("different instants equal")
+	}
+
+	writeTestFile(t, cfg, `{"t": {"sql": "a.sql", "expected": "a.expected.sql", "params": {}, "result": {"timezone": "Mars/Base"}}}`)
+	if _, err := loadTests(cfg, dir); err == nil || !strings.Contains(err.Error(), "result.timezone") {
+		t.Errorf("loadTests error = %v", err)
+	}
+}